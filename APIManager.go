@@ -1,15 +1,229 @@
 package wireguard_go_ubuntu
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 var cl = WireGuardConfig{}
 
-// Обработчики API
+// Блокировка cl: обработчики и фоновые задачи работают с ним одновременно
+var clMu sync.Mutex
+
+// История трафика клиентов
+var history = NewTrafficHistory()
+
+// Журнал сессий клиентов
+var sessions = NewSessionTracker()
+
+// Очередь доставки webhook
+var webhooks = NewWebhookQueue()
+
+// Журнал аудита административных действий
+var audit = NewAuditLog()
+
+// Пароль резервных копий, которые демон сохраняет сам, DaemonConfig.Backup.Passphrase
+var backupPassphrase string
+
+// Файлы состояния, каталог задаётся DaemonConfig.StateDir
+var (
+	stateFile          = filepath.Join(DefaultStateDir, "wg_state.json")
+	trafficHistoryFile = filepath.Join(DefaultStateDir, "traffic_history.json")
+	sessionsFile       = filepath.Join(DefaultStateDir, "sessions.json")
+	webhookQueueFile   = filepath.Join(DefaultStateDir, "webhook_queue.json")
+	auditLogFile       = filepath.Join(DefaultStateDir, "audit.log")
+)
+
+const (
+	webhookInterval        = 10 * time.Second
+	trafficSampleInterval  = 5 * time.Minute
+	peerMonitorInterval    = 30 * time.Second
+	inactivityInterval     = 24 * time.Hour
+	reconcileInterval      = 15 * time.Minute
+	defaultUsageDailyRange = 30 * 24 * time.Hour
+)
+
+// ------------------------ операции с клиентами ------------------------
+// Общие для API и Telegram бота: блокировка cl, вызов метода и сохранение состояния
+
+// Добавление клиента
+func addClient(actor Actor, id int, name string) (Client, error) {
+	clMu.Lock()
+	defer clMu.Unlock()
+
+	client, clID, err := cl.AddWireguardClient(id)
+	if err != nil {
+		return Client{}, err
+	}
+	if name != "" {
+		client.Name = name
+		cl.Clients[clID] = client
+	}
+	saveState()
+	auditAction(actor, AuditClientAdd, client.Id, nil, nil, client)
+	emitLifecycle(LifecycleClientCreated, client, "")
+	return client, nil
+}
+
+// Удаление клиента
+func deleteClient(actor Actor, id int) error {
+	clMu.Lock()
+	defer clMu.Unlock()
+	client := cl.Clients[id]
+	if err := cl.DeleteClient(id); err != nil {
+		return err
+	}
+	saveState()
+	auditAction(actor, AuditClientDelete, id, nil, client, nil)
+	emitLifecycle(LifecycleClientDeleted, client, "")
+	return nil
+}
+
+// Активация клиента
+func activateClient(actor Actor, id int) error {
+	clMu.Lock()
+	defer clMu.Unlock()
+	before := cl.Clients[id]
+	if err := cl.ActClient(id); err != nil {
+		return err
+	}
+	saveState()
+	client := cl.Clients[id]
+	auditAction(actor, AuditClientActivate, id, nil, before, client)
+	emitLifecycle(LifecycleClientActivated, client, "")
+	return nil
+}
+
+// Остановка клиента
+func stopClient(actor Actor, id int) error {
+	clMu.Lock()
+	defer clMu.Unlock()
+	before := cl.Clients[id]
+	if err := cl.StopClient(id); err != nil {
+		return err
+	}
+	saveState()
+	client := cl.Clients[id]
+	auditAction(actor, AuditClientStop, id, nil, before, client)
+	emitLifecycle(LifecycleClientStopped, client, "")
+	return nil
+}
+
+// Настройки сервера для журнала аудита, без клиентов
+func serverSettings(wg WireGuardConfig) WireGuardConfig {
+	wg.Clients = nil
+	wg.LinkCodes = nil
+	return wg
+}
+
+// Запись в журнал аудита, ошибки только логируются
+func auditAction(actor Actor, action string, target int, details map[string]string, before, after interface{}) {
+	if _, err := audit.Append(time.Now(), actor, action, target, details, before, after); err != nil {
+		log.Printf("Ошибка записи журнала аудита: %v", err)
+	}
+}
+
+// Постановка события жизненного цикла в очередь webhook, вызывается под clMu
+func emitLifecycle(eventType string, client Client, reason string) {
+	if len(cl.Webhooks) == 0 {
+		return
+	}
+	now := time.Now()
+	event := WebhookEvent{Type: eventType, Time: now, Reason: reason, Client: client.Info(now)}
+	if err := webhooks.Enqueue(cl.Webhooks, event); err != nil {
+		log.Printf("Ошибка постановки webhook в очередь: %v", err)
+		return
+	}
+	if err := webhooks.SaveToFile(webhookQueueFile); err != nil {
+		log.Printf("Ошибка сохранения очереди webhook: %v", err)
+	}
+}
+
+// Создание ссылки привязки Telegram для клиента
+func createLinkCode(actor Actor, id int, ttl time.Duration) (LinkCode, string, error) {
+	clMu.Lock()
+	token := cl.BotToken
+	clMu.Unlock()
+	if token == "" {
+		return LinkCode{}, "", ErrNoBotToken
+	}
+	bot, err := telegramBot(token)
+	if err != nil {
+		return LinkCode{}, "", err
+	}
+
+	clMu.Lock()
+	defer clMu.Unlock()
+	link, err := cl.NewLinkCode(id, ttl, time.Now())
+	if err != nil {
+		return LinkCode{}, "", err
+	}
+	saveState()
+	auditAction(actor, AuditClientTgLink, id, map[string]string{"expires_at": link.ExpiresAt.Format(time.RFC3339)}, nil, nil)
+	return link, DeepLink(bot.Me.Username, link.Code), nil
+}
+
+// Погашение кода привязки из Telegram
+func redeemLinkCode(code string, tgID int64) (Client, error) {
+	clMu.Lock()
+	defer clMu.Unlock()
+	link, found := cl.LinkCodes[code]
+	before := cl.Clients[link.ClientID]
+	client, err := cl.RedeemLinkCode(code, tgID, time.Now())
+	// Код одноразовый: сохраняем и при ошибке, чтобы не оставлять просроченный
+	saveState()
+	if found && err == nil {
+		actor := Actor{Type: ActorBot, ID: strconv.FormatInt(tgID, 10)}
+		auditAction(actor, AuditClientTgLinkRedeem, client.Id, nil, before, client)
+	}
+	return client, err
+}
+
+// Отправка конфигурации клиенту по его каналам уведомлений
+func deliverConfig(actor Actor, id int) error {
+	clMu.Lock()
+	client, exists := cl.Clients[id]
+	notifiers := cl.Notifiers()
+	clMu.Unlock()
+	if !exists {
+		return clientNotFound(id)
+	}
+
+	n, err := ConfigNotification(client)
+	if err != nil {
+		return err
+	}
+	if err := notifiers.NotifyClient(client, n); err != nil {
+		return err
+	}
+	auditAction(actor, AuditClientConfigDeliver, id, nil, nil, nil)
+	return nil
+}
+
+// Уведомление администраторов, ошибки только логируются
+func notifyAdmins(n Notification) {
+	clMu.Lock()
+	admins := cl
+	clMu.Unlock()
+	if err := admins.NotifyAdmins(n); err != nil {
+		log.Printf("Ошибка уведомления администратора: %v", err)
+	}
+}
+
+// ------------------------ обработчики API ------------------------
 // Добавление клиента
 func AddClientHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -17,7 +231,10 @@ func AddClientHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	id := map[string]int{"id": 0}
+	req := struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	}{}
 	data, err := io.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "Failed to read request body", http.StatusBadRequest)
@@ -25,21 +242,25 @@ func AddClientHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	if err := json.Unmarshal(data, &id); err != nil {
+	if err := json.Unmarshal(data, &req); err != nil {
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
 
-	client, clID, err := cl.AddWireguardClient(id["id"])
+	if planRequested(r) {
+		responsePlan(w, func() (Plan, error) { return cl.PlanAddClient(req.ID) })
+		return
+	}
+	client, err := addClient(apiActor(r), req.ID, req.Name)
 	if err != nil {
-		responseError(w, "Error adding client", http.StatusInternalServerError)
+		responseFailure(w, err, http.StatusInternalServerError)
 		return
 	}
 
 	responseJSON(w, struct {
 		Client Client `json:"client"`
 		ID     int    `json:"id"`
-	}{Client: client, ID: clID})
+	}{Client: client, ID: client.Id})
 }
 
 // Удаление клиента
@@ -62,7 +283,14 @@ func DeleteClientHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cl.DeleteClient(id["id"])
+	if planRequested(r) {
+		responsePlan(w, func() (Plan, error) { return cl.PlanDeleteClient(id["id"]) })
+		return
+	}
+	if err := deleteClient(apiActor(r), id["id"]); err != nil {
+		responseFailure(w, err, http.StatusInternalServerError)
+		return
+	}
 	responseJSON(w, map[string]string{"status": "Client deleted"})
 }
 
@@ -73,7 +301,9 @@ func GetAllClientsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	clMu.Lock()
 	clients := cl.AllClients()
+	clMu.Unlock()
 	responseJSON(w, map[string]string{"clients": clients})
 }
 
@@ -97,7 +327,14 @@ func ActivateClientHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cl.ActClient(id["id"])
+	if planRequested(r) {
+		responsePlan(w, func() (Plan, error) { return cl.PlanClientStatus(id["id"], true) })
+		return
+	}
+	if err := activateClient(apiActor(r), id["id"]); err != nil {
+		responseFailure(w, err, http.StatusInternalServerError)
+		return
+	}
 	responseJSON(w, map[string]string{"status": "Client activated"})
 }
 
@@ -121,7 +358,14 @@ func StopClientHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cl.StopClient(id["id"])
+	if planRequested(r) {
+		responsePlan(w, func() (Plan, error) { return cl.PlanClientStatus(id["id"], false) })
+		return
+	}
+	if err := stopClient(apiActor(r), id["id"]); err != nil {
+		responseFailure(w, err, http.StatusInternalServerError)
+		return
+	}
 	responseJSON(w, map[string]string{"status": "Client stopped"})
 }
 
@@ -132,30 +376,1185 @@ func StartServerHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cl.Autostart()
+	if planRequested(r) {
+		responsePlan(w, cl.PlanAutostart)
+		return
+	}
+	clMu.Lock()
+	before := cl
+	err := cl.Autostart()
+	if err == nil {
+		saveState()
+		auditAction(apiActor(r), AuditServerStart, 0, nil, serverSettings(before), serverSettings(cl))
+	}
+	clMu.Unlock()
+	if err != nil {
+		responseFailure(w, err, http.StatusInternalServerError)
+		return
+	}
 	responseJSON(w, map[string]string{"status": "Server started"})
 }
 
-// Общие функции для ответа JSON
-func responseJSON(w http.ResponseWriter, data interface{}) {
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(data)
+// Состояние сервера
+func StatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	up := refreshPresence() != nil
+	clMu.Lock()
+	status := cl.Status(time.Now(), up)
+	clMu.Unlock()
+	responseJSON(w, status)
 }
 
-func responseError(w http.ResponseWriter, message string, statusCode int) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
-	json.NewEncoder(w).Encode(map[string]string{"error": message})
+// Заголовок с паролем шифрования резервной копии
+const backupPassphraseHeader = "X-Backup-Passphrase"
+
+// Наибольший размер загружаемой резервной копии
+const maxBackupSize = 256 << 20
+
+// Резервная копия сервера; пароль в заголовке X-Backup-Passphrase шифрует архив
+func BackupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+	// В архиве ключи сервера и клиентов, токен бота и пароль SMTP
+	if !requireAuth(w, r) {
+		return
+	}
+
+	passphrase := r.Header.Get(backupPassphraseHeader)
+	now := time.Now()
+	flushState()
+	clMu.Lock()
+	data, err := cl.CreateBackup(now, passphrase)
+	if err == nil {
+		auditAction(apiActor(r), AuditServerBackup, 0, map[string]string{"encrypted": strconv.FormatBool(passphrase != "")}, nil, nil)
+	}
+	clMu.Unlock()
+	if err != nil {
+		responseError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	if passphrase != "" {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, BackupFileName(now, passphrase != "")))
+	w.Write(data)
+}
+
+// Отчёт восстановления из резервной копии
+type RestoreReport struct {
+	Manifest         BackupManifest `json:"manifest"`
+	DryRun           bool           `json:"dry_run"`
+	Files            []string       `json:"files"` // пути, которые записаны или будут записаны
+	Warnings         []string       `json:"warnings"`
+	PreRestoreBackup string         `json:"pre_restore_backup,omitempty"` // копия текущей установки до восстановления
+	Error            string         `json:"error,omitempty"`
+	RolledBack       bool           `json:"rolled_back,omitempty"` // прежние файлы и состояние возвращены
+}
+
+// Восстановление из резервной копии в теле запроса: проверка архива,
+// запись файлов, загрузка состояния и провижининг хоста. Настроенный
+// сервер перезаписывается только с ?force=true, ?plan=true только
+// проверяет архив. Перед записью текущая установка сохраняется в каталог
+// состояния, при ошибке прежние файлы и состояние возвращаются.
+func RestoreHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+	// Восстановление перезаписывает ключи сервера, состояние и wg0.conf
+	if !requireAuth(w, r) {
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBackupSize))
+	if err != nil {
+		responseError(w, "Failed to read backup: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	backup, err := OpenBackup(data, r.Header.Get(backupPassphraseHeader))
+	if err != nil {
+		responseError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	next, err := backup.State()
+	if err != nil {
+		responseError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	report := RestoreReport{Manifest: backup.Manifest, DryRun: planRequested(r), Files: []string{}, Warnings: restoreWarnings(&next)}
+	items := restoredItems()
+	for _, file := range backup.Manifest.Files {
+		if path, ok := items[file.Name]; ok {
+			report.Files = append(report.Files, path)
+		}
+	}
+	if report.DryRun {
+		responseJSON(w, report)
+		return
+	}
+
+	// Копия до восстановления берётся с диска, поэтому сначала сохраняем всё
+	flushState()
+	clMu.Lock()
+	defer clMu.Unlock()
+	configured := cl.PrivateKey != "" || len(cl.Clients) > 0
+	if configured && r.URL.Query().Get("force") != "true" {
+		responseError(w, "Server is already configured, use force=true to overwrite it", http.StatusConflict)
+		return
+	}
+	if report.PreRestoreBackup, err = savePreRestoreBackup(time.Now(), configured); err != nil {
+		responseError(w, "Failed to back up the current install: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	previous := cl
+	var created []string
+	j := NewJournal("restore")
+	err = j.Do("write backup files", func() (func() error, error) {
+		paths := make([]string, 0, len(items))
+		for _, path := range items {
+			paths = append(paths, path)
+		}
+		snapshot := snapshotFiles(paths...)
+		undo := func() error {
+			err := snapshot.restore()
+			reloadStateFiles()
+			if err == nil && wireguardActive() {
+				err = restWireguard()
+			}
+			return err
+		}
+		written, newFiles, err := backup.WriteFiles()
+		report.Files, created = written, newFiles
+		if err != nil {
+			return nil, errors.Join(err, undo())
+		}
+		return undo, nil
+	})
+	if err == nil {
+		err = j.Do("load "+stateFile, func() (func() error, error) {
+			next := WireGuardConfig{}
+			if err := next.LoadFromFile(stateFile); err != nil {
+				return nil, err
+			}
+			// Запись провижининга описывает исходный хост; на этом хосте
+			// отмечается только то, что создали восстановление и провижининг
+			next.Provisioned = ProvisionRecord{At: time.Now()}
+			for _, path := range created {
+				switch path {
+				case serverPrivateKeyFile:
+					next.Provisioned.KeyFiles = true
+				case wgConfigFile:
+					next.Provisioned.ConfigFile = true
+				}
+			}
+			detected := WireGuardConfig{ListenPort: next.ListenPort}
+			if detected.GetIPAndInterfaceName() == nil {
+				next.InterName = detected.InterName
+			}
+			// Пароль SMTP не хранится в состоянии, он берётся из настроек демона
+			next.Notify.SMTPPassword = previous.Notify.SMTPPassword
+			cl = next
+			reloadStateFiles()
+			return func() error {
+				cl = previous
+				return nil
+			}, nil
+		})
+	}
+	if err == nil {
+		err = j.Do("provision", func() (func() error, error) {
+			return nil, cl.Autostart()
+		})
+	}
+	if err = j.Finish(err); err != nil {
+		report.Error = err.Error()
+		report.RolledBack = j.RolledBack
+	}
+	saveState()
+	details := map[string]string{"backup_created_at": backup.Manifest.CreatedAt.Format(time.RFC3339), "hostname": backup.Manifest.Hostname}
+	if report.PreRestoreBackup != "" {
+		details["pre_restore_backup"] = report.PreRestoreBackup
+	}
+	if report.Error != "" {
+		details["error"] = report.Error
+	}
+	auditAction(apiActor(r), AuditServerRestore, 0, details, serverSettings(previous), serverSettings(cl))
+	if report.Error != "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(report)
+		return
+	}
+	responseJSON(w, report)
+}
+
+// Копия текущей установки перед восстановлением в каталог состояния,
+// зашифрованная паролем плановых копий, если он задан. Вызывается под clMu.
+// Если сервер не настроен и копировать нечего, копия не создаётся.
+func savePreRestoreBackup(now time.Time, configured bool) (string, error) {
+	data, err := cl.CreateBackup(now, backupPassphrase)
+	if err != nil {
+		if configured {
+			return "", err
+		}
+		return "", nil
+	}
+	path := filepath.Join(filepath.Dir(stateFile), "wg-prerestore-"+strings.TrimPrefix(BackupFileName(now, backupPassphrase != ""), "wg-backup-"))
+	return path, os.WriteFile(path, data, 0600)
+}
+
+// Совместимость резервной копии с текущим хостом
+func restoreWarnings(next *WireGuardConfig) []string {
+	warnings := []string{}
+	for _, tool := range []string{"wg", "wg-quick", "systemctl"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s is not installed, provisioning will fail", tool))
+		}
+	}
+	detected := WireGuardConfig{ListenPort: next.ListenPort}
+	if err := detected.GetIPAndInterfaceName(); err != nil {
+		return append(warnings, fmt.Sprintf("failed to detect host address: %v", err))
+	}
+	if next.InterName != "" && next.InterName != detected.InterName {
+		if next.InterfaceConf != "" {
+			warnings = append(warnings, fmt.Sprintf("imported [Interface] section refers to %s, this host uses %s", next.InterName, detected.InterName))
+		} else {
+			warnings = append(warnings, fmt.Sprintf("outbound interface changes from %s to %s", next.InterName, detected.InterName))
+		}
+	}
+	if host, _ := splitEndpoint(next.Endpoint); host != "" {
+		if detectedHost, _ := splitEndpoint(detected.Endpoint); detectedHost != host {
+			warnings = append(warnings, fmt.Sprintf("client configs point to %s, this host is %s; move the address or DNS name before clients reconnect", host, detectedHost))
+		}
+	}
+	return warnings
+}
+
+// Повторная загрузка очереди, сессий и истории из восстановленных файлов.
+// Журнал аудита восстановлением не меняется.
+func reloadStateFiles() {
+	if err := webhooks.LoadFromFile(webhookQueueFile); err != nil {
+		log.Printf("Ошибка загрузки очереди webhook: %v", err)
+	}
+	if err := sessions.LoadFromFile(sessionsFile); err != nil {
+		log.Printf("Ошибка загрузки журнала сессий: %v", err)
+	}
+	if err := history.LoadFromFile(trafficHistoryFile); err != nil {
+		log.Printf("Ошибка загрузки истории трафика: %v", err)
+	}
+}
+
+// Плановая резервная копия в каталог dir с хранением keep последних
+func scheduledBackup(dir string, keep int, passphrase string) {
+	now := time.Now()
+	flushState()
+	clMu.Lock()
+	data, err := cl.CreateBackup(now, passphrase)
+	clMu.Unlock()
+	if err == nil {
+		err = os.MkdirAll(dir, 0700)
+	}
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, BackupFileName(now, passphrase != "")), data, 0600)
+	}
+	if err != nil {
+		log.Printf("Ошибка плановой резервной копии: %v", err)
+		notifyAdmins(Notification{Event: EventAdmin, Subject: "Ошибка резервной копии WireGuard", Text: err.Error()})
+		return
+	}
+	if _, err := PruneBackups(dir, keep); err != nil {
+		log.Printf("Ошибка удаления старых резервных копий: %v", err)
+	}
+}
+
+// Удаление сервера с хоста: ?backup=false отключает резервную копию,
+// которая по умолчанию сохраняется в каталог состояния перед удалением.
+// Копия шифруется паролем плановых копий; без него в ответе предупреждение,
+// что ключи в ней открытым текстом.
+func TeardownHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAuth(w, r) {
+		return
+	}
+
+	var backupFile, warning string
+	var backup func() error
+	if r.URL.Query().Get("backup") != "false" {
+		now := time.Now()
+		backupFile = filepath.Join(filepath.Dir(stateFile), "wg-teardown-"+strings.TrimPrefix(BackupFileName(now, backupPassphrase != ""), "wg-backup-"))
+		if backupPassphrase == "" {
+			warning = "backup is not encrypted and holds the server and client private keys in plain text, set backup.passphrase to encrypt it"
+		}
+		backup = func() error {
+			saveState()
+			data, err := cl.CreateBackup(now, backupPassphrase)
+			if err != nil {
+				return err
+			}
+			return os.WriteFile(backupFile, data, 0600)
+		}
+	}
+
+	clMu.Lock()
+	before := cl
+	journal, err := cl.DropWireguard(backup)
+	saveState()
+	details := map[string]string{}
+	if backupFile != "" {
+		details["backup"] = backupFile
+		details["encrypted"] = strconv.FormatBool(backupPassphrase != "")
+	}
+	if err != nil {
+		details["error"] = err.Error()
+	}
+	auditAction(apiActor(r), AuditServerTeardown, 0, details, serverSettings(before), serverSettings(cl))
+	clMu.Unlock()
+
+	resp := map[string]interface{}{"backup": backupFile, "journal": journal}
+	if warning != "" {
+		resp["warning"] = warning
+	}
+	if err != nil {
+		resp["error"] = err.Error()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+	responseJSON(w, resp)
+}
+
+// Список клиентов с состоянием подключения
+func ListClientsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	refreshPresence()
+	now := time.Now()
+	clMu.Lock()
+	clients := make([]ClientInfo, 0, len(cl.Clients))
+	for _, client := range cl.Clients {
+		clients = append(clients, client.Info(now))
+	}
+	clMu.Unlock()
+
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Id < clients[j].Id })
+	responseJSON(w, map[string]interface{}{"clients": clients})
+}
+
+// Сведения об одном клиенте
+func GetClientHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid client id", http.StatusBadRequest)
+		return
+	}
+
+	refreshPresence()
+	clMu.Lock()
+	client, exists := cl.Clients[id]
+	clMu.Unlock()
+	if !exists {
+		responseError(w, "Client not found", http.StatusNotFound)
+		return
+	}
+	responseJSON(w, client.Info(time.Now()))
+}
+
+// Выгрузка конфигурации клиента: conf, networkmanager, networkd, openwrt, routeros, png, svg или zip
+func ClientConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid client id", http.StatusBadRequest)
+		return
+	}
+
+	clMu.Lock()
+	client, exists := cl.Clients[id]
+	clMu.Unlock()
+	if !exists {
+		responseError(w, "Client not found", http.StatusNotFound)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "conf"
+	}
+	name := ConfigFileName(client)
+	base := name[:len(name)-len(".conf")]
+
+	var data []byte
+	var contentType, fileName string
+	switch format {
+	case ConfigFormatWgQuick:
+		data, contentType, fileName = []byte(client.Config), "text/plain", name
+	case ConfigFormatNetworkManager, ConfigFormatNetworkd, ConfigFormatOpenWrt, ConfigFormatRouterOS:
+		clMu.Lock()
+		files, ferr := cl.ClientConfig(client).Files(format)
+		clMu.Unlock()
+		err = ferr
+		if err == nil && len(files) == 1 {
+			data, contentType, fileName = files[0].Data, "text/plain", files[0].Name
+		} else if err == nil {
+			data, err = zipFiles(files)
+			contentType, fileName = "application/zip", base+"-"+format+".zip"
+		}
+	case "png":
+		data, err = ConfigQRPNG(client, DefaultQRSize)
+		contentType, fileName = "image/png", base+".png"
+	case "svg":
+		data, err = ConfigQRSVG(client)
+		contentType, fileName = "image/svg+xml", base+".svg"
+	case "zip":
+		data, err = ConfigBundle(client)
+		contentType, fileName = "application/zip", base+".zip"
+	default:
+		http.Error(w, "Unknown format", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		responseError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	auditAction(apiActor(r), AuditClientConfigDownload, id, map[string]string{"format": format}, nil, nil)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, fileName))
+	w.Write(data)
 }
 
-func main() {
-	http.HandleFunc("/addClient", AddClientHandler)
-	http.HandleFunc("/deleteClient", DeleteClientHandler)
-	http.HandleFunc("/getAllClients", GetAllClientsHandler)
-	http.HandleFunc("/activateClient", ActivateClientHandler)
-	http.HandleFunc("/stopClient", StopClientHandler)
-	http.HandleFunc("/startServer", StartServerHandler)
+// Контакты и предпочтения уведомлений клиента
+func ClientContactHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid client id", http.StatusBadRequest)
+		return
+	}
+	req := struct {
+		TgId           int      `json:"tg_id"`
+		Email          string   `json:"email"`
+		WebhookURL     string   `json:"webhook_url"`
+		NotifyChannels []string `json:"notify_channels"`
+	}{}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+	if err := json.Unmarshal(data, &req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	for _, channel := range req.NotifyChannels {
+		if channel != ChannelTelegram && channel != ChannelEmail && channel != ChannelWebhook {
+			responseError(w, "Unknown notify channel: "+channel, http.StatusBadRequest)
+			return
+		}
+	}
 
-	log.Println("API server started on :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	if planRequested(r) {
+		responsePlan(w, func() (Plan, error) {
+			client, exists := cl.Clients[id]
+			if !exists {
+				return Plan{}, clientNotFound(id)
+			}
+			before := req
+			before.TgId, before.Email, before.WebhookURL, before.NotifyChannels = client.TgId, client.Email, client.WebhookURL, client.NotifyChannels
+			return PlanSettings(fmt.Sprintf("update contact client %d", id), fmt.Sprintf("client %d", id), before, req)
+		})
+		return
+	}
+	clMu.Lock()
+	client, exists := cl.Clients[id]
+	if exists {
+		before := client
+		client.TgId = req.TgId
+		client.Email = req.Email
+		client.WebhookURL = req.WebhookURL
+		client.NotifyChannels = req.NotifyChannels
+		cl.Clients[id] = client
+		saveState()
+		auditAction(apiActor(r), AuditClientContact, id, nil, before, client)
+	}
+	clMu.Unlock()
+	if !exists {
+		responseError(w, "Client not found", http.StatusNotFound)
+		return
+	}
+	responseJSON(w, map[string]string{"status": "Contact updated"})
+}
+
+// Отправка конфигурации клиенту через уведомления
+func DeliverConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid client id", http.StatusBadRequest)
+		return
+	}
+	if err := deliverConfig(apiActor(r), id); err != nil {
+		responseFailure(w, err, http.StatusBadGateway)
+		return
+	}
+	responseJSON(w, map[string]string{"status": "Config delivered"})
+}
+
+// QR-код конфигурации клиента в формате PNG
+func ClientQRHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid client id", http.StatusBadRequest)
+		return
+	}
+	size := DefaultQRSize
+	if v := r.URL.Query().Get("size"); v != "" {
+		size, err = strconv.Atoi(v)
+		if err != nil || size <= 0 || size > 2048 {
+			http.Error(w, "Invalid size", http.StatusBadRequest)
+			return
+		}
+	}
+
+	clMu.Lock()
+	client, exists := cl.Clients[id]
+	clMu.Unlock()
+	if !exists {
+		responseError(w, "Client not found", http.StatusNotFound)
+		return
+	}
+
+	png, err := ConfigQRPNG(client, size)
+	if err != nil {
+		responseError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// QR-код содержит полную конфигурацию с приватным ключом
+	auditAction(apiActor(r), AuditClientConfigDownload, id, map[string]string{"format": "qr"}, nil, nil)
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(png)
+}
+
+// Ссылка для привязки Telegram аккаунта к клиенту
+func ClientTgLinkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid client id", http.StatusBadRequest)
+		return
+	}
+	req := struct {
+		TTLHours int `json:"ttl_hours"`
+	}{}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+	}
+
+	link, url, err := createLinkCode(apiActor(r), id, time.Duration(req.TTLHours)*time.Hour)
+	if err != nil {
+		responseFailure(w, err, http.StatusBadRequest)
+		return
+	}
+	responseJSON(w, map[string]interface{}{
+		"link":       url,
+		"code":       link.Code,
+		"expires_at": link.ExpiresAt,
+	})
+}
+
+// Сессии подключения клиента
+func ClientSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid client id", http.StatusBadRequest)
+		return
+	}
+	from, to, err := parseDateRange(r, defaultUsageDailyRange)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	responseJSON(w, map[string]interface{}{
+		"client_id": id,
+		"sessions":  sessions.ClientSessions(id, from, to),
+	})
+}
+
+// Политика простоя: просмотр (GET) и изменение (PUT)
+func InactivityPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		clMu.Lock()
+		policy := cl.Inactivity
+		clMu.Unlock()
+		responseJSON(w, policy)
+	case http.MethodPut:
+		var policy InactivityPolicy
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		defer r.Body.Close()
+
+		if err := json.Unmarshal(data, &policy); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if err := policy.Validate(); err != nil {
+			responseError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if planRequested(r) {
+			responsePlan(w, func() (Plan, error) {
+				return PlanSettings("inactivity policy", "inactivity", cl.Inactivity, policy)
+			})
+			return
+		}
+		clMu.Lock()
+		before := cl.Inactivity
+		cl.Inactivity = policy
+		saveState()
+		auditAction(apiActor(r), AuditInactivityPolicy, 0, nil, before, policy)
+		clMu.Unlock()
+		responseJSON(w, policy)
+	default:
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+	}
+}
+
+// Отчёт о простаивающих клиентах без изменений (dry-run)
+func InactivityReportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	refreshPresence()
+	clMu.Lock()
+	report := cl.CheckInactivity(time.Now(), true)
+	clMu.Unlock()
+	responseJSON(w, report)
+}
+
+// Запуск проверки простоя по настроенной политике
+func InactivityRunHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	responseJSON(w, runInactivityCheck(apiActor(r)))
+}
+
+// Импорт существующей установки: ?path= — файл или каталог источника,
+// ?plan=true — только отчёт без сохранения
+func ImportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	source, path := r.PathValue("source"), r.URL.Query().Get("path")
+	clMu.Lock()
+	defer clMu.Unlock()
+	next := cl.clone()
+	report, err := next.ImportFrom(source, path, time.Now())
+	if err != nil {
+		responseError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	report.DryRun = planRequested(r)
+	if report.DryRun {
+		responseJSON(w, report)
+		return
+	}
+
+	// Работающий wg0.conf переписывается без перезапуска
+	if ImportTakesOver(source, path) {
+		if err := next.TakeOverConfig(); err != nil {
+			responseError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else {
+		report.warn("%s was not changed, run reconcile or startServer to apply the imported state", wgConfigFile)
+	}
+	cl = next
+	saveState()
+	auditAction(apiActor(r), AuditServerImport, 0, map[string]string{"source": source, "path": path, "clients": strconv.Itoa(len(report.Imported))}, nil, nil)
+	responseJSON(w, report)
+}
+
+// Отчёт сверки состояния, wg0.conf и устройства без изменений
+func DriftReportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+	responseJSON(w, runReconcile(apiActor(r), false))
+}
+
+// Сверка с приведением хоста к сохранённому состоянию
+func ReconcileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+	report := runReconcile(apiActor(r), true)
+	if report.Error != "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(report)
+		return
+	}
+	responseJSON(w, report)
+}
+
+// Журнал доставки webhook, ?status=pending|delivered|failed
+func WebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	if status != "" && status != DeliveryPending && status != DeliveryDelivered && status != DeliveryFailed {
+		responseError(w, "Unknown delivery status", http.StatusBadRequest)
+		return
+	}
+	responseJSON(w, webhooks.Deliveries(status))
+}
+
+// Последние журналы применения изменений на хосте
+func JournalHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+	responseJSON(w, map[string]interface{}{"journals": RecentJournals()})
+}
+
+// Журнал аудита: ?client=&action=&actor=api|bot|cli|system&from=&to=&limit=
+func AuditLogHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := AuditQuery{Action: r.URL.Query().Get("action"), ActorType: r.URL.Query().Get("actor")}
+	var err error
+	if v := r.URL.Query().Get("client"); v != "" {
+		if q.Target, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "Invalid client id", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := r.URL.Query().Get("from"); v != "" {
+		if q.From, err = time.Parse("2006-01-02", v); err != nil {
+			http.Error(w, "Invalid from date", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := r.URL.Query().Get("to"); v != "" {
+		if q.To, err = time.Parse("2006-01-02", v); err != nil {
+			http.Error(w, "Invalid to date", http.StatusBadRequest)
+			return
+		}
+	}
+
+	responseJSON(w, map[string]interface{}{"records": audit.Query(q)})
+}
+
+// Проверка цепочки хэшей журнала аудита
+func AuditVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	seq, err := audit.Verify()
+	if err != nil {
+		responseJSON(w, map[string]interface{}{"valid": false, "broken_seq": seq, "error": err.Error()})
+		return
+	}
+	responseJSON(w, map[string]interface{}{"valid": true})
+}
+
+// Использование трафика клиентом по дням или месяцам
+func ClientUsageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid client id", http.StatusBadRequest)
+		return
+	}
+	period := r.PathValue("period")
+	if period != "daily" && period != "monthly" {
+		http.Error(w, "Unknown period", http.StatusNotFound)
+		return
+	}
+
+	defaultRange := defaultUsageDailyRange
+	if period == "monthly" {
+		defaultRange = 365 * 24 * time.Hour
+	}
+	from, to, err := parseDateRange(r, defaultRange)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	responseJSON(w, map[string]interface{}{
+		"client_id": id,
+		"period":    period,
+		"usage":     history.Usage(id, from, to, period),
+	})
+}
+
+// Выгрузка суточного использования всех клиентов в CSV или JSON
+func UsageExportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	from, to, err := parseDateRange(r, defaultUsageDailyRange)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rows := history.Export(from, to)
+
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		responseJSON(w, rows)
+	case "csv":
+		data, err := UsageCSV(rows)
+		if err != nil {
+			responseError(w, "Error building CSV", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="usage.csv"`)
+		w.Write(data)
+	default:
+		http.Error(w, "Unknown format", http.StatusBadRequest)
+	}
+}
+
+// Метрики в формате Prometheus
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats, err := cl.CollectPeerStats()
+	if err != nil {
+		log.Printf("Ошибка сбора статистики пиров: %v", err)
+	}
+
+	clMu.Lock()
+	clients := make(map[int]Client, len(cl.Clients))
+	for id, client := range cl.Clients {
+		clients[id] = client
+	}
+	clMu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	WritePeerMetrics(w, clients, stats, time.Now())
+	metrics.Write(w)
+}
+
+// Разбор параметров from/to (YYYY-MM-DD), to не включается в интервал
+func parseDateRange(r *http.Request, defaultRange time.Duration) (time.Time, time.Time, error) {
+	to := time.Now().UTC()
+	from := to.Add(-defaultRange)
+
+	q := r.URL.Query()
+	if v := q.Get("from"); v != "" {
+		t, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid from date: %s", v)
+		}
+		from = t
+	}
+	if v := q.Get("to"); v != "" {
+		t, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid to date: %s", v)
+		}
+		to = t
+	}
+	return from, to, nil
+}
+
+// Сохранение состояния cl, вызывается под clMu
+func saveState() {
+	if err := cl.SaveToFile(stateFile); err != nil {
+		log.Printf("Ошибка сохранения состояния: %v", err)
+	}
+}
+
+// Обновление рукопожатий клиентов по данным устройства
+func refreshPresence() map[string]PeerStats {
+	stats, err := cl.CollectPeerStats()
+	if err != nil {
+		log.Printf("Ошибка сбора статистики пиров: %v", err)
+		return nil
+	}
+
+	clMu.Lock()
+	defer clMu.Unlock()
+	if cl.UpdatePresence(stats) {
+		saveState()
+	}
+	return stats
+}
+
+// Опрос устройства: присутствие и сессии клиентов
+func samplePeers() {
+	stats := refreshPresence()
+	if stats == nil {
+		return
+	}
+
+	clMu.Lock()
+	keys := cl.ClientKeys()
+	clMu.Unlock()
+
+	sessions.Observe(time.Now(), stats, keys)
+	if err := sessions.SaveToFile(sessionsFile); err != nil {
+		log.Printf("Ошибка сохранения журнала сессий: %v", err)
+	}
+}
+
+// Проверка простоя с уведомлением администраторов
+func runInactivityCheck(actor Actor) InactivityReport {
+	refreshPresence()
+
+	clMu.Lock()
+	before := make(map[int]Client, len(cl.Clients))
+	for id, client := range cl.Clients {
+		before[id] = client
+	}
+	report := cl.CheckInactivity(time.Now(), false)
+	if !report.DryRun && len(report.Clients) > 0 {
+		saveState()
+	}
+	for _, entry := range report.Clients {
+		if entry.Action == "" {
+			continue
+		}
+		auditAction(actor, AuditClientInactive, entry.Id, map[string]string{"action": entry.Action}, before[entry.Id], cl.Clients[entry.Id])
+		// Остановка по простою — окончание доступа клиента
+		if entry.Action == InactivityActionStop {
+			emitLifecycle(LifecycleClientExpired, cl.Clients[entry.Id], "inactivity")
+		}
+	}
+	clMu.Unlock()
+
+	if len(report.Clients) > 0 {
+		notifyAdmins(Notification{Subject: "Проверка простоя клиентов", Text: report.Text()})
+	}
+	return report
+}
+
+// Сверка состояния, wg0.conf и устройства; при repair расхождения исправляются
+func runReconcile(actor Actor, repair bool) DriftReport {
+	device, err := cl.CollectPeerStats()
+	if err != nil {
+		device = nil
+	}
+
+	clMu.Lock()
+	defer clMu.Unlock()
+	report := cl.CheckDrift(time.Now(), device)
+	if !repair || report.InSync {
+		return report
+	}
+	err = cl.Reconcile(report)
+	saveState()
+	details := map[string]string{"issues": strconv.Itoa(len(report.Issues))}
+	if err != nil {
+		report.Error = err.Error()
+		details["error"] = report.Error
+	} else {
+		report.Repaired = true
+		device, _ = cl.CollectPeerStats()
+		report.Remaining = cl.CheckDrift(time.Now(), device).Issues
+	}
+	auditAction(actor, AuditServerReconcile, 0, details, nil, nil)
+	return report
+}
+
+// Последний текст расхождений периодической сверки, чтобы не повторять уведомление
+var lastDriftText string
+
+// Периодическая сверка: администраторы уведомляются, когда расхождения меняются
+func periodicReconcile(repair bool) {
+	report := runReconcile(Actor{Type: ActorSystem, ID: "reconcile"}, repair)
+	// Известные расхождения тоже сообщаются, но только один раз
+	text := ""
+	if len(report.Issues) > 0 {
+		text = report.Text()
+	}
+	if text != "" && text != lastDriftText {
+		notifyAdmins(Notification{Event: EventAdmin, Subject: "Расхождение конфигурации WireGuard", Text: text})
+	}
+	lastDriftText = text
+}
+
+// Отправка webhook из очереди с повторами
+func dispatchWebhooks() {
+	if !webhooks.ProcessDue(time.Now()) {
+		return
+	}
+	if err := webhooks.SaveToFile(webhookQueueFile); err != nil {
+		log.Printf("Ошибка сохранения очереди webhook: %v", err)
+	}
+}
+
+// Сбор трафика в историю
+func sampleTraffic() {
+	traffic, err := cl.CollectTraffic()
+	if err != nil {
+		log.Printf("Ошибка сбора трафика: %v", err)
+		return
+	}
+
+	clMu.Lock()
+	keys := cl.ClientKeys()
+	clMu.Unlock()
+
+	history.Record(time.Now(), traffic, keys)
+	if err := history.SaveToFile(trafficHistoryFile); err != nil {
+		log.Printf("Ошибка сохранения истории трафика: %v", err)
+	}
+}
+
+// Вызов fn с интервалом до отмены ctx
+func runEvery(ctx context.Context, interval time.Duration, fn func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fn()
+		}
+	}
+}
+
+// Запрошен план вместо выполнения: ?plan=true
+func planRequested(r *http.Request) bool {
+	return r.URL.Query().Get("plan") == "true"
+}
+
+// Ответ с планом изменения; plan вызывается под clMu и ничего не меняет
+func responsePlan(w http.ResponseWriter, plan func() (Plan, error)) {
+	clMu.Lock()
+	p, err := plan()
+	clMu.Unlock()
+	if err != nil {
+		responseFailure(w, err, http.StatusInternalServerError)
+		return
+	}
+	responseJSON(w, p)
+}
+
+// Общие функции для ответа JSON
+func responseJSON(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
+
+func responseError(w http.ResponseWriter, message string, statusCode int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// Ответ с ошибкой метода сервера или клиента: статус по типу ошибки,
+// для упавшей команды — её вывод в поле output
+func responseFailure(w http.ResponseWriter, err error, fallback int) {
+	body := map[string]string{"error": err.Error()}
+	var cmdErr *CommandError
+	if errors.As(err, &cmdErr) {
+		body["command"] = cmdErr.Command
+		body["output"] = cmdErr.Output
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(errorStatus(err, fallback))
+	json.NewEncoder(w).Encode(body)
 }
@@ -0,0 +1,355 @@
+package wireguard_go_ubuntu
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Инициаторы действий
+const (
+	ActorAPI    = "api"    // запрос к API
+	ActorBot    = "bot"    // администратор в Telegram боте
+	ActorCLI    = "cli"    // пользователь CLI
+	ActorSystem = "system" // фоновые задачи сервера
+)
+
+// Действия журнала аудита
+const (
+	AuditClientAdd            = "client.add"
+	AuditClientDelete         = "client.delete"
+	AuditClientActivate       = "client.activate"
+	AuditClientStop           = "client.stop"
+	AuditClientContact        = "client.contact"
+	AuditClientConfigDownload = "client.config_download"
+	AuditClientConfigDeliver  = "client.config_deliver"
+	AuditClientTgLink         = "client.tglink"
+	AuditClientTgLinkRedeem   = "client.tglink_redeem"
+	AuditClientInactive       = "client.inactive"
+	AuditServerStart          = "server.start"
+	AuditServerBackup         = "server.backup"
+	AuditServerTeardown       = "server.teardown"
+	AuditServerReconcile      = "server.reconcile"
+	AuditServerImport         = "server.import"
+	AuditServerRestore        = "server.restore"
+	AuditInactivityPolicy     = "inactivity.policy"
+)
+
+// Поля, которые не попадают в журнал: секреты и часто меняющиеся данные присутствия
+var auditSkipFields = map[string]bool{
+	"private_client_key": true,
+	"preshared_key":      true,
+	"peer_str":           true, // секция [Peer] клиента с PresharedKey
+	"config":             true,
+	"private_key":        true,
+	"interface_conf":     true, // импортированная секция [Interface] с PrivateKey
+	"bot_token":          true,
+	"smtp_password":      true,
+	"secret":             true,
+	"latest_handshake":   true,
+	"current_endpoint":   true,
+	"first_seen":         true,
+	"last_seen":          true,
+}
+
+// Инициатор действия
+type Actor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`             // отпечаток токена API, Telegram ID или пользователь ОС
+	Addr string `json:"addr,omitempty"` // адрес запроса API
+}
+
+// Изменение поля
+type AuditChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// Запись журнала аудита. Hash = sha256(PrevHash + JSON записи с пустым Hash),
+// поэтому изменение или удаление записи ломает цепочку.
+type AuditRecord struct {
+	Seq      int64             `json:"seq"`
+	Time     time.Time         `json:"time"`
+	Actor    Actor             `json:"actor"`
+	Action   string            `json:"action"`
+	Target   int               `json:"target,omitempty"`  // id клиента, 0 — сервер
+	Details  map[string]string `json:"details,omitempty"` // параметры действия, например формат выгрузки
+	Changes  json.RawMessage   `json:"changes,omitempty"` // map[поле]AuditChange
+	PrevHash string            `json:"prev_hash"`
+	Hash     string            `json:"hash"`
+}
+
+// Фильтр выборки журнала
+type AuditQuery struct {
+	Target    int // 0 — все
+	Action    string
+	ActorType string
+	From, To  time.Time // нулевые — без ограничения
+	Limit     int       // 0 — без ограничения, иначе последние Limit записей
+}
+
+// Журнал аудита: только добавление, по записи JSON на строку
+type AuditLog struct {
+	mu      sync.Mutex
+	path    string
+	records []AuditRecord
+	broken  *auditBroken // файл не прочитан целиком: записи не загружены, добавление запрещено
+}
+
+// Повреждение файла журнала: номер первой нечитаемой записи и причина
+type auditBroken struct {
+	seq int64
+	err error
+}
+
+func NewAuditLog() *AuditLog {
+	return &AuditLog{}
+}
+
+// Открытие файла журнала: загрузка существующих записей, дальнейшие записи
+// дописываются в файл. Если файл не читается целиком, журнал помечается
+// повреждённым: частичные записи не сохраняются, Append и Verify
+// возвращают ошибку, иначе новые записи продолжили бы цепочку после
+// нечитаемой строки.
+func (a *AuditLog) Open(filename string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.path = filename
+	a.records = nil
+	a.broken = nil
+	records, err := readAuditRecords(filename)
+	if err != nil {
+		a.broken = &auditBroken{seq: int64(len(records) + 1), err: err}
+		return err
+	}
+	a.records = records
+	return nil
+}
+
+// Чтение записей журнала; при ошибке возвращаются записи до неё
+func readAuditRecords(filename string) ([]AuditRecord, error) {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []AuditRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var rec AuditRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return records, fmt.Errorf("invalid audit record after seq %d: %v", len(records), err)
+		}
+		records = append(records, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return records, fmt.Errorf("failed to read audit record after seq %d: %v", len(records), err)
+	}
+	return records, nil
+}
+
+// Хэш записи
+func (rec AuditRecord) computeHash() (string, error) {
+	rec.Hash = ""
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(append([]byte(rec.PrevHash), data...))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Добавление записи. before и after — состояние объекта до и после действия
+// (nil, если объекта не было), в журнал попадают только изменённые поля.
+func (a *AuditLog) Append(now time.Time, actor Actor, action string, target int, details map[string]string, before, after interface{}) (AuditRecord, error) {
+	rec := AuditRecord{
+		Time:    now.UTC(),
+		Actor:   actor,
+		Action:  action,
+		Target:  target,
+		Details: details,
+	}
+	changes, err := AuditDiff(before, after)
+	if err != nil {
+		return AuditRecord{}, err
+	}
+	if len(changes) > 0 {
+		if rec.Changes, err = json.Marshal(changes); err != nil {
+			return AuditRecord{}, err
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.broken != nil {
+		return AuditRecord{}, fmt.Errorf("audit log is damaged: %v", a.broken.err)
+	}
+	if n := len(a.records); n > 0 {
+		rec.Seq = a.records[n-1].Seq + 1
+		rec.PrevHash = a.records[n-1].Hash
+	} else {
+		rec.Seq = 1
+	}
+	if rec.Hash, err = rec.computeHash(); err != nil {
+		return AuditRecord{}, err
+	}
+
+	if a.path != "" {
+		line, err := json.Marshal(rec)
+		if err != nil {
+			return AuditRecord{}, err
+		}
+		f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return AuditRecord{}, err
+		}
+		_, err = f.Write(append(line, '\n'))
+		if err == nil {
+			err = f.Sync()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return AuditRecord{}, fmt.Errorf("failed to write audit record: %v", err)
+		}
+	}
+	a.records = append(a.records, rec)
+	return rec, nil
+}
+
+// Выборка записей по фильтру, в порядке добавления
+func (a *AuditLog) Query(q AuditQuery) []AuditRecord {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	result := []AuditRecord{}
+	for _, rec := range a.records {
+		if q.Target != 0 && rec.Target != q.Target {
+			continue
+		}
+		if q.Action != "" && rec.Action != q.Action {
+			continue
+		}
+		if q.ActorType != "" && rec.Actor.Type != q.ActorType {
+			continue
+		}
+		if !q.From.IsZero() && rec.Time.Before(q.From) {
+			continue
+		}
+		if !q.To.IsZero() && !rec.Time.Before(q.To) {
+			continue
+		}
+		result = append(result, rec)
+	}
+	if q.Limit > 0 && len(result) > q.Limit {
+		result = result[len(result)-q.Limit:]
+	}
+	return result
+}
+
+// Проверка цепочки хэшей. Возвращает номер первой повреждённой записи или 0.
+func (a *AuditLog) Verify() (int64, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.broken != nil {
+		return a.broken.seq, a.broken.err
+	}
+
+	prev := ""
+	for i, rec := range a.records {
+		if rec.Seq != int64(i+1) {
+			return rec.Seq, fmt.Errorf("audit record %d: expected seq %d", rec.Seq, i+1)
+		}
+		if rec.PrevHash != prev {
+			return rec.Seq, fmt.Errorf("audit record %d: chain is broken", rec.Seq)
+		}
+		hash, err := rec.computeHash()
+		if err != nil {
+			return rec.Seq, err
+		}
+		if hash != rec.Hash {
+			return rec.Seq, fmt.Errorf("audit record %d: hash mismatch", rec.Seq)
+		}
+		prev = rec.Hash
+	}
+	return 0, nil
+}
+
+// Поля объекта в виде JSON без секретов; nil — пустой набор
+func auditFields(v interface{}) (map[string]interface{}, error) {
+	fields := map[string]interface{}{}
+	if v == nil || (reflect.ValueOf(v).Kind() == reflect.Ptr && reflect.ValueOf(v).IsNil()) {
+		return fields, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	skipAuditFields(fields)
+	return fields, nil
+}
+
+// Удаление auditSkipFields на всех уровнях: секреты бывают и во вложенных
+// объектах, например secret подписок webhook в настройках сервера
+func skipAuditFields(v interface{}) {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for name, field := range value {
+			if auditSkipFields[name] {
+				delete(value, name)
+				continue
+			}
+			skipAuditFields(field)
+		}
+	case []interface{}:
+		for _, item := range value {
+			skipAuditFields(item)
+		}
+	}
+}
+
+// Изменённые поля между двумя состояниями объекта
+func AuditDiff(before, after interface{}) (map[string]AuditChange, error) {
+	b, err := auditFields(before)
+	if err != nil {
+		return nil, err
+	}
+	a, err := auditFields(after)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := map[string]AuditChange{}
+	for name, value := range b {
+		if !reflect.DeepEqual(value, a[name]) {
+			changes[name] = AuditChange{Before: value, After: a[name]}
+		}
+	}
+	for name, value := range a {
+		if _, ok := b[name]; !ok {
+			changes[name] = AuditChange{Before: nil, After: value}
+		}
+	}
+	return changes, nil
+}
@@ -0,0 +1,66 @@
+package wireguard_go_ubuntu
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditSkipsNestedSecrets(t *testing.T) {
+	before := WireGuardConfig{ListenPort: "51820", Webhooks: []WebhookEndpoint{{URL: "https://a.example", Secret: "old-secret"}}}
+	after := WireGuardConfig{ListenPort: "51821", Webhooks: []WebhookEndpoint{{URL: "https://b.example", Secret: "new-secret"}}}
+
+	log := NewAuditLog()
+	rec, err := log.Append(time.Now(), Actor{Type: ActorSystem}, AuditServerRestore, 0, nil, serverSettings(before), serverSettings(after))
+	if err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	changes := string(rec.Changes)
+	for _, secret := range []string{"old-secret", "new-secret", `"secret"`} {
+		if strings.Contains(changes, secret) {
+			t.Errorf("changes contain %s: %s", secret, changes)
+		}
+	}
+	for _, field := range []string{"listen_port", "https://b.example"} {
+		if !strings.Contains(changes, field) {
+			t.Errorf("changes lack %s: %s", field, changes)
+		}
+	}
+}
+
+func TestAuditOpenDamagedLog(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	log := NewAuditLog()
+	if err := log.Open(filename); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := log.Append(time.Now(), Actor{Type: ActorSystem}, AuditServerStart, 0, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("{garbage\n")
+	f.Close()
+	damaged, _ := os.ReadFile(filename)
+
+	log = NewAuditLog()
+	if err := log.Open(filename); err == nil {
+		t.Fatal("Open() accepted a damaged log")
+	}
+	if n := len(log.Query(AuditQuery{})); n != 0 {
+		t.Errorf("damaged log keeps %d partial records", n)
+	}
+	if seq, err := log.Verify(); err == nil || seq != 2 {
+		t.Errorf("Verify() = %d, %v; want record 2 broken", seq, err)
+	}
+	if _, err := log.Append(time.Now(), Actor{Type: ActorSystem}, AuditServerStart, 0, nil, nil, nil); err == nil {
+		t.Error("Append() wrote to a damaged log")
+	}
+	if data, _ := os.ReadFile(filename); string(data) != string(damaged) {
+		t.Error("damaged log file was changed")
+	}
+}
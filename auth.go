@@ -0,0 +1,120 @@
+package wireguard_go_ubuntu
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Файл токена wgctl в каталоге состояния: создаётся демоном с правами 0600,
+// его читает wgctl на том же хосте
+const cliTokenFileName = "cli_token"
+
+// Токены API: apiToken — для интеграций из настроек (может быть пуст),
+// cliToken — собственный токен wgctl
+var apiToken, cliToken string
+
+// Учётные данные запроса, прошедшего requireAPIToken
+const (
+	credentialAPI = "api"
+	credentialCLI = "cli"
+)
+
+// Токен wgctl из файла; если файла нет, токен создаётся
+func loadCLIToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if token := strings.TrimSpace(string(data)); token != "" {
+			return token, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate CLI token: %v", err)
+	}
+	token := hex.EncodeToString(buf)
+	if err := os.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return "", fmt.Errorf("failed to write CLI token: %v", err)
+	}
+	return token, nil
+}
+
+// Токен из заголовка Authorization: Bearer
+func bearerToken(r *http.Request) string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+func tokenEqual(got, want string) bool {
+	return want != "" && subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+// Проверка токена до обработчика: запрос без верного токена получает 401.
+// Вид учётных данных передаётся обработчику в контексте.
+func requireAPIToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := bearerToken(r)
+		var credential string
+		switch {
+		case tokenEqual(token, cliToken):
+			credential = credentialCLI
+		case tokenEqual(token, apiToken):
+			credential = credentialAPI
+		default:
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			responseError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authKey{}, credential)))
+	})
+}
+
+// Ключ контекста: учётные данные запроса, прошедшего requireAPIToken
+type authKey struct{}
+
+func requestCredential(r *http.Request) string {
+	credential, _ := r.Context().Value(authKey{}).(string)
+	return credential
+}
+
+// Проверка в обработчиках, которые отдают или перезаписывают секреты: они
+// не работают, даже если маршрут подключён без requireAPIToken
+func requireAuth(w http.ResponseWriter, r *http.Request) bool {
+	if requestCredential(r) != "" {
+		return true
+	}
+	responseError(w, "Unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+// Заголовок, в котором wgctl передаёт пользователя ОС
+const cliUserHeader = "X-Wgctl-User"
+
+// Инициатор запроса API по проверенным учётным данным: для токена
+// интеграций — его отпечаток, сам токен не сохраняется. Пользователю из
+// cliUserHeader верим только с токеном wgctl, который читает лишь root.
+func apiActor(r *http.Request) Actor {
+	actor := Actor{Type: ActorAPI, ID: "anonymous", Addr: r.RemoteAddr}
+	switch requestCredential(r) {
+	case credentialCLI:
+		actor.Type, actor.ID = ActorCLI, "unknown"
+		if user := r.Header.Get(cliUserHeader); user != "" {
+			actor.ID = user
+		}
+	case credentialAPI:
+		sum := sha256.Sum256([]byte(bearerToken(r)))
+		actor.ID = "token:" + hex.EncodeToString(sum[:6])
+	}
+	return actor
+}
@@ -0,0 +1,368 @@
+package wireguard_go_ubuntu
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Версия формата архива резервной копии
+const backupFormatVersion = 1
+
+// Описание архива
+const backupManifestName = "manifest.json"
+
+// Снимок правил межсетевого экрана: только для справки, при восстановлении
+// правила создаются заново провижинингом и PostUp
+const backupFirewallName = "firewall.txt"
+
+// Заголовок зашифрованного архива: за ним соль scrypt, nonce и AES-256-GCM
+var backupEncryptedMagic = []byte("WGBACKUP-ENC1\n")
+
+// Параметры scrypt для ключа из пароля
+const (
+	backupScryptN    = 1 << 15
+	backupScryptR    = 8
+	backupScryptP    = 1
+	backupSaltLength = 16
+)
+
+// Описание резервной копии: версия формата, сервер, запись провижининга
+// и контрольные суммы файлов
+type BackupManifest struct {
+	Version     int             `json:"version"`
+	StateSchema int             `json:"state_schema"` // версия схемы файла состояния
+	CreatedAt   time.Time       `json:"created_at"`
+	Hostname    string          `json:"hostname"`
+	Server      BackupServer    `json:"server"`
+	Provisioned ProvisionRecord `json:"provisioned"` // что было создано провижинингом на исходном хосте
+	Files       []BackupFile    `json:"files"`
+}
+
+// Сервер на момент резервной копии
+type BackupServer struct {
+	PublicKey  string `json:"public_key"`
+	ListenPort string `json:"listen_port"`
+	Endpoint   string `json:"endpoint"`
+	InterName  string `json:"inter_name"`
+	Clients    int    `json:"clients"`
+}
+
+// Файл архива. Path — путь на исходном хосте; при восстановлении файл
+// пишется по пути того же назначения на текущем хосте.
+type BackupFile struct {
+	Name   string `json:"name"`
+	Path   string `json:"path,omitempty"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Журнал аудита в архиве только для справки: при восстановлении он не
+// записывается, иначе записи после копии пропали бы вместе с цепочкой хэшей
+const backupAuditLogName = "audit.log"
+
+// Файлы резервной копии по назначению
+func backupItems() map[string]string {
+	return map[string]string{
+		"wg_state.json":        stateFile,
+		"wg0.conf":             wgConfigFile,
+		"privatekey":           serverPrivateKeyFile,
+		"publickey":            serverPublicKeyFile,
+		"traffic_history.json": trafficHistoryFile,
+		"sessions.json":        sessionsFile,
+		"webhook_queue.json":   webhookQueueFile,
+		backupAuditLogName:     auditLogFile,
+	}
+}
+
+// Файлы, которые восстановление записывает на хост: все, кроме журнала аудита
+func restoredItems() map[string]string {
+	items := backupItems()
+	delete(items, backupAuditLogName)
+	return items
+}
+
+// Архив резервной копии: файлы состояния, ключи сервера, wg0.conf,
+// история трафика и снимок правил межсетевого экрана. Непустой passphrase
+// шифрует архив. Отсутствующие файлы пропускаются.
+func (wg *WireGuardConfig) CreateBackup(now time.Time, passphrase string) ([]byte, error) {
+	hostname, _ := os.Hostname()
+	manifest := BackupManifest{
+		Version:     backupFormatVersion,
+		StateSchema: StateSchemaVersion,
+		CreatedAt:   now.UTC(),
+		Hostname:    hostname,
+		Server: BackupServer{
+			PublicKey:  wg.PublicKey,
+			ListenPort: wg.ListenPort,
+			Endpoint:   wg.Endpoint,
+			InterName:  wg.InterName,
+			Clients:    len(wg.Clients),
+		},
+		Provisioned: wg.Provisioned,
+		Files:       []BackupFile{},
+	}
+
+	items := backupItems()
+	names := make([]string, 0, len(items))
+	for name := range items {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var files []ConfigFile
+	add := func(name, path string, data []byte) {
+		sum := sha256.Sum256(data)
+		manifest.Files = append(manifest.Files, BackupFile{Name: name, Path: path, Size: len(data), SHA256: hex.EncodeToString(sum[:])})
+		files = append(files, ConfigFile{name, data})
+	}
+	for _, name := range names {
+		data, err := os.ReadFile(items[name])
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", items[name], err)
+		}
+		add(name, items[name], data)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no state files to back up")
+	}
+	if firewall := firewallSnapshot(); firewall != nil {
+		add(backupFirewallName, "", firewall)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	archive, err := zipFiles(append([]ConfigFile{{backupManifestName, data}}, files...))
+	if err != nil || passphrase == "" {
+		return archive, err
+	}
+	return encryptBackup(archive, passphrase)
+}
+
+// Правила iptables и статус ufw, если они доступны
+func firewallSnapshot() []byte {
+	var buf bytes.Buffer
+	for _, args := range [][]string{{"iptables-save"}, {"ufw", "status", "verbose"}} {
+		out, err := exec.Command(args[0], args[1:]...).Output()
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(&buf, "# %s\n%s\n", strings.Join(args, " "), out)
+	}
+	if buf.Len() == 0 {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// Имя файла резервной копии
+func BackupFileName(now time.Time, encrypted bool) string {
+	name := fmt.Sprintf("wg-backup-%s.zip", now.UTC().Format("20060102-150405"))
+	if encrypted {
+		name += ".enc"
+	}
+	return name
+}
+
+// Архив зашифрован паролем
+func BackupEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, backupEncryptedMagic)
+}
+
+func backupCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, backupScryptN, backupScryptR, backupScryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encryptBackup(archive []byte, passphrase string) ([]byte, error) {
+	salt := make([]byte, backupSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := backupCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append(append(append([]byte{}, backupEncryptedMagic...), salt...), nonce...)
+	return aead.Seal(out, nonce, archive, backupEncryptedMagic), nil
+}
+
+func decryptBackup(data []byte, passphrase string) ([]byte, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("backup is encrypted, passphrase required")
+	}
+	data = data[len(backupEncryptedMagic):]
+	if len(data) < backupSaltLength {
+		return nil, fmt.Errorf("encrypted backup is truncated")
+	}
+	aead, err := backupCipher(passphrase, data[:backupSaltLength])
+	if err != nil {
+		return nil, err
+	}
+	data = data[backupSaltLength:]
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted backup is truncated")
+	}
+	archive, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], backupEncryptedMagic)
+	if err != nil {
+		return nil, fmt.Errorf("wrong passphrase or corrupted backup")
+	}
+	return archive, nil
+}
+
+// Прочитанная резервная копия
+type Backup struct {
+	Manifest BackupManifest
+	Files    map[string][]byte
+}
+
+// Чтение и проверка архива: версия формата, контрольные суммы и файл
+// состояния, в том числе версия его схемы. Зашифрованный архив требует пароль.
+func OpenBackup(data []byte, passphrase string) (*Backup, error) {
+	if BackupEncrypted(data) {
+		var err error
+		if data, err = decryptBackup(data, passphrase); err != nil {
+			return nil, err
+		}
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup archive: %v", err)
+	}
+	backup := &Backup{Files: map[string][]byte{}}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		content, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", f.Name, err)
+		}
+		backup.Files[f.Name] = content
+	}
+
+	manifest, ok := backup.Files[backupManifestName]
+	if !ok {
+		return nil, fmt.Errorf("backup has no %s, archives made before versioned backups cannot be restored", backupManifestName)
+	}
+	if err := json.Unmarshal(manifest, &backup.Manifest); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", backupManifestName, err)
+	}
+	if backup.Manifest.Version > backupFormatVersion {
+		return nil, fmt.Errorf("backup format %d is newer than supported %d", backup.Manifest.Version, backupFormatVersion)
+	}
+	for _, file := range backup.Manifest.Files {
+		content, ok := backup.Files[file.Name]
+		if !ok {
+			return nil, fmt.Errorf("backup is missing %s", file.Name)
+		}
+		sum := sha256.Sum256(content)
+		if hex.EncodeToString(sum[:]) != file.SHA256 {
+			return nil, fmt.Errorf("checksum mismatch for %s", file.Name)
+		}
+	}
+	if _, err := backup.State(); err != nil {
+		return nil, err
+	}
+	return backup, nil
+}
+
+// Состояние из резервной копии, приведённое к текущей схеме. Более новая
+// схема не поддерживается.
+func (b *Backup) State() (WireGuardConfig, error) {
+	var wg WireGuardConfig
+	state, ok := b.Files["wg_state.json"]
+	if !ok {
+		return wg, fmt.Errorf("backup has no state file")
+	}
+	migrated, _, err := migrateState(state)
+	if err != nil {
+		return wg, fmt.Errorf("state file in backup: %v", err)
+	}
+	if err := json.Unmarshal(migrated, &wg); err != nil {
+		return wg, fmt.Errorf("invalid state file in backup: %v", err)
+	}
+	return wg, nil
+}
+
+// Запись файлов резервной копии по путям текущего хоста. Возвращает
+// записанные пути и те из них, которых на хосте не было. Журнал аудита
+// не записывается.
+func (b *Backup) WriteFiles() (written, created []string, err error) {
+	items := restoredItems()
+	for _, file := range b.Manifest.Files {
+		path, ok := items[file.Name]
+		if !ok {
+			continue
+		}
+		if _, statErr := os.Stat(path); os.IsNotExist(statErr) {
+			created = append(created, path)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return written, created, err
+		}
+		if err := os.WriteFile(path, b.Files[file.Name], 0600); err != nil {
+			return written, created, err
+		}
+		written = append(written, path)
+	}
+	return written, created, nil
+}
+
+// Удаление старых резервных копий в dir сверх keep последних
+func PruneBackups(dir string, keep int) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasPrefix(entry.Name(), "wg-backup-") {
+			names = append(names, entry.Name())
+		}
+	}
+	// Имена содержат время UTC, порядок строк совпадает с порядком создания
+	sort.Strings(names)
+	var removed []string
+	for len(names) > keep {
+		path := filepath.Join(dir, names[0])
+		if err := os.Remove(path); err != nil {
+			return removed, err
+		}
+		removed = append(removed, path)
+		names = names[1:]
+	}
+	return removed, nil
+}
@@ -0,0 +1,147 @@
+package wireguard_go_ubuntu
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Архив резервной копии с манифестом; files — содержимое, sums — суммы в
+// манифесте, если должны отличаться от настоящих
+func testBackupArchive(t *testing.T, files map[string][]byte, sums map[string]string) []byte {
+	t.Helper()
+	manifest := BackupManifest{Version: backupFormatVersion, StateSchema: StateSchemaVersion}
+	var list []ConfigFile
+	for name, data := range files {
+		sum := sha256.Sum256(data)
+		file := BackupFile{Name: name, Size: len(data), SHA256: hex.EncodeToString(sum[:])}
+		if s, ok := sums[name]; ok {
+			file.SHA256 = s
+		}
+		manifest.Files = append(manifest.Files, file)
+		list = append(list, ConfigFile{name, data})
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := zipFiles(append([]ConfigFile{{backupManifestName, data}}, list...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return archive
+}
+
+func TestBackupEncryptRoundTrip(t *testing.T) {
+	archive := testBackupArchive(t, map[string][]byte{
+		"wg_state.json": []byte(`{"schema_version":1,"private_key":"server-key","clients":{}}`),
+	}, nil)
+
+	encrypted, err := encryptBackup(archive, "secret")
+	if err != nil {
+		t.Fatalf("encryptBackup: %v", err)
+	}
+	if !BackupEncrypted(encrypted) {
+		t.Fatal("encrypted backup has no header")
+	}
+	if bytes.Contains(encrypted, []byte("server-key")) {
+		t.Fatal("encrypted backup contains plaintext")
+	}
+
+	decrypted, err := decryptBackup(encrypted, "secret")
+	if err != nil {
+		t.Fatalf("decryptBackup: %v", err)
+	}
+	if !bytes.Equal(decrypted, archive) {
+		t.Fatal("decrypted archive differs from the original")
+	}
+
+	backup, err := OpenBackup(encrypted, "secret")
+	if err != nil {
+		t.Fatalf("OpenBackup: %v", err)
+	}
+	state, err := backup.State()
+	if err != nil {
+		t.Fatalf("State: %v", err)
+	}
+	if state.PrivateKey != "server-key" {
+		t.Errorf("private key = %q, want server-key", state.PrivateKey)
+	}
+}
+
+func TestOpenBackupRejects(t *testing.T) {
+	state := []byte(`{"schema_version":1,"clients":{}}`)
+	archive := testBackupArchive(t, map[string][]byte{"wg_state.json": state}, nil)
+	encrypted, err := encryptBackup(archive, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupted := append([]byte{}, encrypted...)
+	corrupted[len(corrupted)-1] ^= 0xff
+
+	tests := []struct {
+		name       string
+		data       []byte
+		passphrase string
+		want       string
+	}{
+		{"wrong passphrase", encrypted, "wrong", "wrong passphrase"},
+		{"no passphrase", encrypted, "", "passphrase required"},
+		{"corrupted ciphertext", corrupted, "secret", "corrupted backup"},
+		{"truncated", encrypted[:len(backupEncryptedMagic)+4], "secret", "truncated"},
+		{
+			name: "tampered checksum",
+			data: testBackupArchive(t, map[string][]byte{"wg_state.json": state},
+				map[string]string{"wg_state.json": strings.Repeat("0", 64)}),
+			want: "checksum mismatch for wg_state.json",
+		},
+		{
+			name: "newer state schema",
+			data: testBackupArchive(t, map[string][]byte{"wg_state.json": []byte(`{"schema_version":99}`)}, nil),
+			want: "newer than supported",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := OpenBackup(tt.data, tt.passphrase)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("OpenBackup() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackupWriteFilesKeepsAuditLog(t *testing.T) {
+	dir := t.TempDir()
+	setStateDir(dir)
+	defer setStateDir(DefaultStateDir)
+	live := []byte(`{"seq":1}` + "\n" + `{"seq":2}` + "\n")
+	if err := os.WriteFile(auditLogFile, live, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	state := []byte(`{"schema_version":1,"clients":{}}`)
+	archive := testBackupArchive(t, map[string][]byte{
+		"wg_state.json":    state,
+		backupAuditLogName: []byte(`{"seq":1}` + "\n"),
+	}, nil)
+	backup, err := OpenBackup(archive, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	written, _, err := backup.WriteFiles()
+	if err != nil {
+		t.Fatalf("WriteFiles: %v", err)
+	}
+	if len(written) != 1 || written[0] != filepath.Join(dir, "wg_state.json") {
+		t.Errorf("written = %v, want only the state file", written)
+	}
+	if data, _ := os.ReadFile(auditLogFile); !bytes.Equal(data, live) {
+		t.Errorf("audit log was overwritten: %q", data)
+	}
+}
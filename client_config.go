@@ -0,0 +1,252 @@
+package wireguard_go_ubuntu
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// DNS сервер в конфигурациях клиентов
+const DefaultClientDNS = "8.8.8.8"
+
+// Типизированная конфигурация клиента, из которой строятся все форматы
+type ClientConfig struct {
+	Name                string   // имя интерфейса/подключения на стороне клиента
+	Address             string   // адрес клиента с маской, например 10.0.0.2/24
+	PrivateKey          string   // приватный ключ клиента
+	DNS                 []string // DNS серверы
+	PeerPublicKey       string   // публичный ключ сервера
+	PeerEndpoint        string   // адрес сервера host:port
+	PresharedKey        string   // общий ключ пары клиент-сервер, пусто — не используется
+	AllowedIPs          []string // маршрутизируемые через туннель сети
+	PersistentKeepalive int      // интервал keepalive в секундах, 0 — выключен
+}
+
+// Форматы выгрузки конфигурации клиента
+const (
+	ConfigFormatWgQuick        = "conf"
+	ConfigFormatNetworkManager = "networkmanager"
+	ConfigFormatNetworkd       = "networkd"
+	ConfigFormatOpenWrt        = "openwrt"
+	ConfigFormatRouterOS       = "routeros"
+)
+
+// Файл выгрузки конфигурации
+type ConfigFile struct {
+	Name string
+	Data []byte
+}
+
+// Файлы конфигурации в заданном формате
+func (c ClientConfig) Files(format string) ([]ConfigFile, error) {
+	switch format {
+	case ConfigFormatWgQuick:
+		return []ConfigFile{{c.Name + ".conf", []byte(c.WgQuick())}}, nil
+	case ConfigFormatNetworkManager:
+		return []ConfigFile{{c.Name + ".nmconnection", []byte(c.NetworkManager())}}, nil
+	case ConfigFormatNetworkd:
+		netdev, network := c.SystemdNetworkd()
+		return []ConfigFile{{c.Name + ".netdev", []byte(netdev)}, {c.Name + ".network", []byte(network)}}, nil
+	case ConfigFormatOpenWrt:
+		return []ConfigFile{{c.Name + "-openwrt.sh", []byte(c.OpenWrt())}}, nil
+	case ConfigFormatRouterOS:
+		return []ConfigFile{{c.Name + ".rsc", []byte(c.RouterOS())}}, nil
+	default:
+		return nil, fmt.Errorf("unknown config format: %s", format)
+	}
+}
+
+// Конфигурация клиента по данным клиента и сервера
+func (wg *WireGuardConfig) ClientConfig(client Client) ClientConfig {
+	endpoint, publicKey := client.Peer.Endpoint, client.Peer.PublicKey
+	if endpoint == "" {
+		endpoint = wg.Endpoint
+	}
+	if publicKey == "" {
+		publicKey = wg.PublicKey
+	}
+	name := ConfigFileName(client)
+	return ClientConfig{
+		Name:          strings.TrimSuffix(name, ".conf"),
+		Address:       client.AddressClient,
+		PrivateKey:    client.PrivateClientKey,
+		DNS:           []string{DefaultClientDNS},
+		PeerPublicKey: publicKey,
+		PeerEndpoint:  endpoint,
+		PresharedKey:  client.PresharedKey,
+		AllowedIPs:    []string{"0.0.0.0/0"},
+	}
+}
+
+// Полный туннель: весь трафик идёт через сервер
+func (c ClientConfig) fullTunnel() bool {
+	for _, ip := range c.AllowedIPs {
+		if ip == "0.0.0.0/0" {
+			return true
+		}
+	}
+	return false
+}
+
+// Конфигурация wg-quick
+func (c ClientConfig) WgQuick() string {
+	var b strings.Builder
+	b.WriteString("[Interface]\n")
+	fmt.Fprintf(&b, "Address = %s\n", c.Address)
+	fmt.Fprintf(&b, "PrivateKey = %s\n", c.PrivateKey)
+	if len(c.DNS) > 0 {
+		fmt.Fprintf(&b, "DNS = %s\n", strings.Join(c.DNS, ", "))
+	}
+	b.WriteString("\n[Peer]\n")
+	fmt.Fprintf(&b, "Endpoint = %s\n", c.PeerEndpoint)
+	fmt.Fprintf(&b, "PublicKey = %s\n", c.PeerPublicKey)
+	if c.PresharedKey != "" {
+		fmt.Fprintf(&b, "PresharedKey = %s\n", c.PresharedKey)
+	}
+	fmt.Fprintf(&b, "AllowedIPs = %s\n", strings.Join(c.AllowedIPs, ", "))
+	if c.PersistentKeepalive > 0 {
+		fmt.Fprintf(&b, "PersistentKeepalive = %d\n", c.PersistentKeepalive)
+	}
+	return b.String()
+}
+
+// Keyfile NetworkManager (/etc/NetworkManager/system-connections/<name>.nmconnection, права 0600)
+func (c ClientConfig) NetworkManager() string {
+	var b strings.Builder
+	b.WriteString("[connection]\n")
+	fmt.Fprintf(&b, "id=%s\n", c.Name)
+	b.WriteString("type=wireguard\n")
+	fmt.Fprintf(&b, "interface-name=%s\n", c.Name)
+	b.WriteString("\n[wireguard]\n")
+	fmt.Fprintf(&b, "private-key=%s\n", c.PrivateKey)
+	fmt.Fprintf(&b, "\n[wireguard-peer.%s]\n", c.PeerPublicKey)
+	fmt.Fprintf(&b, "endpoint=%s\n", c.PeerEndpoint)
+	if c.PresharedKey != "" {
+		fmt.Fprintf(&b, "preshared-key=%s\n", c.PresharedKey)
+		b.WriteString("preshared-key-flags=0\n")
+	}
+	fmt.Fprintf(&b, "allowed-ips=%s;\n", strings.Join(c.AllowedIPs, ";"))
+	if c.PersistentKeepalive > 0 {
+		fmt.Fprintf(&b, "persistent-keepalive=%d\n", c.PersistentKeepalive)
+	}
+	b.WriteString("\n[ipv4]\n")
+	fmt.Fprintf(&b, "address1=%s\n", c.Address)
+	if len(c.DNS) > 0 {
+		fmt.Fprintf(&b, "dns=%s;\n", strings.Join(c.DNS, ";"))
+	}
+	b.WriteString("method=manual\n")
+	b.WriteString("\n[ipv6]\n")
+	b.WriteString("method=disabled\n")
+	return b.String()
+}
+
+// Пара файлов systemd-networkd: <name>.netdev и <name>.network (/etc/systemd/network/).
+// Для полного туннеля используется отдельная таблица маршрутизации и правило
+// по fwmark, чтобы пакеты к самому серверу не уходили в туннель.
+func (c ClientConfig) SystemdNetworkd() (netdev, network string) {
+	const fwmark, table = "0x8888", "1000"
+
+	var nd strings.Builder
+	nd.WriteString("[NetDev]\n")
+	fmt.Fprintf(&nd, "Name=%s\n", c.Name)
+	nd.WriteString("Kind=wireguard\n")
+	nd.WriteString("\n[WireGuard]\n")
+	fmt.Fprintf(&nd, "PrivateKey=%s\n", c.PrivateKey)
+	if c.fullTunnel() {
+		fmt.Fprintf(&nd, "FirewallMark=%s\n", fwmark)
+		fmt.Fprintf(&nd, "RouteTable=%s\n", table)
+	} else {
+		nd.WriteString("RouteTable=main\n")
+	}
+	nd.WriteString("\n[WireGuardPeer]\n")
+	fmt.Fprintf(&nd, "PublicKey=%s\n", c.PeerPublicKey)
+	fmt.Fprintf(&nd, "Endpoint=%s\n", c.PeerEndpoint)
+	if c.PresharedKey != "" {
+		fmt.Fprintf(&nd, "PresharedKey=%s\n", c.PresharedKey)
+	}
+	fmt.Fprintf(&nd, "AllowedIPs=%s\n", strings.Join(c.AllowedIPs, ","))
+	if c.PersistentKeepalive > 0 {
+		fmt.Fprintf(&nd, "PersistentKeepalive=%d\n", c.PersistentKeepalive)
+	}
+
+	var nw strings.Builder
+	nw.WriteString("[Match]\n")
+	fmt.Fprintf(&nw, "Name=%s\n", c.Name)
+	nw.WriteString("\n[Network]\n")
+	fmt.Fprintf(&nw, "Address=%s\n", c.Address)
+	for _, dns := range c.DNS {
+		fmt.Fprintf(&nw, "DNS=%s\n", dns)
+	}
+	if c.fullTunnel() {
+		nw.WriteString("\n[RoutingPolicyRule]\n")
+		fmt.Fprintf(&nw, "FirewallMark=%s\n", fwmark)
+		nw.WriteString("InvertRule=true\n")
+		fmt.Fprintf(&nw, "Table=%s\n", table)
+		nw.WriteString("Priority=10\n")
+	}
+	return nd.String(), nw.String()
+}
+
+// Команды UCI для OpenWrt
+func (c ClientConfig) OpenWrt() string {
+	host, port := splitEndpoint(c.PeerEndpoint)
+	peer := c.Name + "_server"
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "uci set network.%s=interface\n", c.Name)
+	fmt.Fprintf(&b, "uci set network.%s.proto='wireguard'\n", c.Name)
+	fmt.Fprintf(&b, "uci set network.%s.private_key='%s'\n", c.Name, c.PrivateKey)
+	fmt.Fprintf(&b, "uci add_list network.%s.addresses='%s'\n", c.Name, c.Address)
+	for _, dns := range c.DNS {
+		fmt.Fprintf(&b, "uci add_list network.%s.dns='%s'\n", c.Name, dns)
+	}
+	fmt.Fprintf(&b, "uci set network.%s=wireguard_%s\n", peer, c.Name)
+	fmt.Fprintf(&b, "uci set network.%s.public_key='%s'\n", peer, c.PeerPublicKey)
+	fmt.Fprintf(&b, "uci set network.%s.endpoint_host='%s'\n", peer, host)
+	fmt.Fprintf(&b, "uci set network.%s.endpoint_port='%s'\n", peer, port)
+	if c.PresharedKey != "" {
+		fmt.Fprintf(&b, "uci set network.%s.preshared_key='%s'\n", peer, c.PresharedKey)
+	}
+	for _, ip := range c.AllowedIPs {
+		fmt.Fprintf(&b, "uci add_list network.%s.allowed_ips='%s'\n", peer, ip)
+	}
+	fmt.Fprintf(&b, "uci set network.%s.route_allowed_ips='1'\n", peer)
+	if c.PersistentKeepalive > 0 {
+		fmt.Fprintf(&b, "uci set network.%s.persistent_keepalive='%d'\n", peer, c.PersistentKeepalive)
+	}
+	fmt.Fprintf(&b, "# Добавьте интерфейс %s в зону firewall wan, если нужен выход в интернет\n", c.Name)
+	b.WriteString("uci commit network\n")
+	b.WriteString("/etc/init.d/network reload\n")
+	return b.String()
+}
+
+// Скрипт RouterOS v7 (MikroTik)
+func (c ClientConfig) RouterOS() string {
+	host, port := splitEndpoint(c.PeerEndpoint)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "/interface wireguard add name=%s private-key=\"%s\"\n", c.Name, c.PrivateKey)
+	fmt.Fprintf(&b, "/interface wireguard peers add interface=%s public-key=\"%s\" endpoint-address=%s endpoint-port=%s allowed-address=%s",
+		c.Name, c.PeerPublicKey, host, port, strings.Join(c.AllowedIPs, ","))
+	if c.PresharedKey != "" {
+		fmt.Fprintf(&b, " preshared-key=\"%s\"", c.PresharedKey)
+	}
+	if c.PersistentKeepalive > 0 {
+		fmt.Fprintf(&b, " persistent-keepalive=%ds", c.PersistentKeepalive)
+	}
+	b.WriteString("\n")
+	fmt.Fprintf(&b, "/ip address add address=%s interface=%s\n", c.Address, c.Name)
+	if c.fullTunnel() {
+		b.WriteString("# Маршрут по умолчанию через туннель настраивается отдельно, с исключением для адреса сервера\n")
+	}
+	return b.String()
+}
+
+// Разделение endpoint на хост и порт
+func splitEndpoint(endpoint string) (string, string) {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return endpoint, ""
+	}
+	return host, port
+}
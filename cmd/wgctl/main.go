@@ -0,0 +1,995 @@
+// wgctl — администрирование сервера WireGuard из командной строки через API демона wgmanager.
+//
+// Адрес API задаётся флагом -api или переменной WGCTL_API (по умолчанию http://127.0.0.1:8080).
+// Токен API — переменная WGCTL_TOKEN или файл -token-file (по умолчанию
+// /etc/wireguard/cli_token, его создаёт wgmanager).
+// Флаг -json выводит ответ в JSON вместо таблицы.
+//
+// Коды завершения: 0 — успех, 1 — ошибка выполнения, 2 — неверные аргументы,
+// 3 — клиент не найден, 4 — демон недоступен, 5 — конфликт с состоянием
+// сервера: клиент уже активен или уже остановлен, restore без -force.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	wg "wireguard_go_ubuntu"
+)
+
+// Коды завершения
+const (
+	exitOK          = 0
+	exitError       = 1
+	exitUsage       = 2
+	exitNotFound    = 3
+	exitUnavailable = 4
+	exitConflict    = 5
+)
+
+const usageText = `Использование: wgctl [-api URL] [-token-file файл] [-json] <команда> [аргументы]
+
+Команды:
+  init [-plan]                      настроить и запустить сервер
+  status                            состояние сервера
+  client add <id> [-name имя] [-plan]
+                                    добавить клиента
+  client list                       список клиентов
+  client show <id>                  сведения о клиенте
+  client stop <id> [-plan]          остановить клиента
+  client start <id> [-plan]         активировать клиента
+  client delete <id> [-plan]        удалить клиента
+  client config <id> [-format f] [-qr] [-ascii] [-o файл]
+                                    конфигурация клиента или QR-код в терминале
+  client contact <id> [-tg id] [-email адрес] [-webhook url]
+                 [-channels telegram,email,webhook] [-plan]
+                                    заменить контакты и каналы уведомлений клиента,
+                                    не заданные поля очищаются
+  inactivity                        политика простоя клиентов
+  inactivity set [-days n] [-action flag|stop] [-enforce=true|false] [-plan]
+                                    изменить политику, не заданные поля сохраняются
+  usage [-client id] [-period daily|monthly] [-from YYYY-MM-DD] [-to YYYY-MM-DD]
+                                    использование трафика
+  backup [-o файл] [-passphrase-file файл]
+                                    резервная копия сервера, с паролем — зашифрованная
+  restore <файл> [-passphrase-file файл] [-force] [-plan]
+                                    восстановить сервер из резервной копии
+  import <источник> [-path путь] [-plan]
+                                    перенести существующую установку, источник:
+                                    wg-quick, wg-easy или pivpn
+  drift [-repair]                   сверка состояния, wg0.conf и устройства
+  teardown -yes [-no-backup]        удалить сервер с хоста, по умолчанию
+                                    с резервной копией в каталоге состояния
+
+С -plan команда показывает diff wg0.conf, sysctl и правил межсетевого
+экрана и список команд, ничего не меняя на сервере. Для client contact
+и inactivity set план — diff настроек.
+
+Пароль резервной копии читается из -passphrase-file или переменной
+WGCTL_BACKUP_PASSPHRASE.
+
+Токен API читается из переменной WGCTL_TOKEN или из -token-file,
+по умолчанию /etc/wireguard/cli_token.
+`
+
+// Ошибка с кодом завершения
+type cliError struct {
+	code int
+	msg  string
+}
+
+func (e *cliError) Error() string { return e.msg }
+
+func usageError(format string, args ...interface{}) error {
+	return &cliError{exitUsage, fmt.Sprintf(format, args...)}
+}
+
+// Клиент API демона
+type apiClient struct {
+	base   string
+	token  string
+	user   string
+	client *http.Client
+}
+
+// Запрос к API с телом JSON: ответ 404 — exitNotFound, 409 — exitConflict,
+// прочие ошибки HTTP — exitError, ошибка соединения — exitUnavailable
+func (a *apiClient) do(method, path string, body interface{}) ([]byte, error) {
+	if body == nil {
+		return a.send(method, path, nil, nil)
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	return a.send(method, path, bytes.NewReader(data), http.Header{"Content-Type": {"application/json"}})
+}
+
+// Запрос к API с произвольным телом и заголовками
+func (a *apiClient) send(method, path string, body io.Reader, header http.Header) ([]byte, error) {
+	req, err := http.NewRequest(method, a.base+path, body)
+	if err != nil {
+		return nil, &cliError{exitUsage, fmt.Sprintf("invalid API address: %v", err)}
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("X-Wgctl-User", a.user)
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, &cliError{exitUnavailable, fmt.Sprintf("daemon is unavailable: %v", err)}
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return data, nil
+	}
+
+	msg := strings.TrimSpace(string(data))
+	var apiErr struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(data, &apiErr) == nil && apiErr.Error != "" {
+		msg = apiErr.Error
+	}
+	code := exitError
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		code = exitNotFound
+	case http.StatusConflict:
+		code = exitConflict
+	}
+	return nil, &cliError{code, fmt.Sprintf("%s %s: %d %s", method, path, resp.StatusCode, msg)}
+}
+
+// Запрос с разбором JSON ответа
+func (a *apiClient) getJSON(path string, v interface{}) error {
+	data, err := a.do(http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Команда wgctl
+type command struct {
+	api     *apiClient
+	jsonOut bool
+	out     io.Writer
+}
+
+// Набор флагов подкоманды, всегда принимает -json
+func (c *command) flags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.BoolVar(&c.jsonOut, "json", c.jsonOut, "вывод в JSON")
+	return fs
+}
+
+// Разбор флагов и позиционных аргументов в любом порядке
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, usageError("%s: %v", fs.Name(), err)
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// Разбор id клиента
+func clientID(fs *flag.FlagSet, args []string) (int, error) {
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return 0, err
+	}
+	if len(positional) != 1 {
+		return 0, usageError("%s: expected client id", fs.Name())
+	}
+	id, err := strconv.Atoi(positional[0])
+	if err != nil || id <= 0 {
+		return 0, usageError("%s: invalid client id %q", fs.Name(), positional[0])
+	}
+	return id, nil
+}
+
+// Вывод значения в JSON
+func (c *command) printJSON(v interface{}) error {
+	enc := json.NewEncoder(c.out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// Таблица с выравниванием колонок
+func (c *command) table(header string, rows [][]string) {
+	tw := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, header)
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	tw.Flush()
+}
+
+// Дата или прочерк для нулевого времени
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
+
+func statusText(active bool) string {
+	if active {
+		return "active"
+	}
+	return "stopped"
+}
+
+func (c *command) run(args []string) error {
+	if len(args) == 0 {
+		return usageError("command is required")
+	}
+	switch args[0] {
+	case "init":
+		return c.init(args[1:])
+	case "status":
+		return c.status(args[1:])
+	case "client":
+		return c.client(args[1:])
+	case "usage":
+		return c.usage(args[1:])
+	case "backup":
+		return c.backup(args[1:])
+	case "restore":
+		return c.restore(args[1:])
+	case "import":
+		return c.importInstall(args[1:])
+	case "drift":
+		return c.drift(args[1:])
+	case "inactivity":
+		return c.inactivity(args[1:])
+	case "teardown":
+		return c.teardown(args[1:])
+	case "help", "-h", "--help":
+		fmt.Fprint(c.out, usageText)
+		return nil
+	default:
+		return usageError("unknown command %q", args[0])
+	}
+}
+
+func (c *command) init(args []string) error {
+	fs := c.flags("init")
+	plan := fs.Bool("plan", false, "показать план без изменений")
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+	if *plan {
+		return c.showPlan(http.MethodPost, "/startServer", nil)
+	}
+	if _, err := c.api.do(http.MethodPost, "/startServer", nil); err != nil {
+		return err
+	}
+	return c.status(nil)
+}
+
+func (c *command) status(args []string) error {
+	if _, err := parseArgs(c.flags("status"), args); err != nil {
+		return err
+	}
+	var status wg.ServerStatus
+	if err := c.api.getJSON("/api/v1/status", &status); err != nil {
+		return err
+	}
+	if c.jsonOut {
+		return c.printJSON(status)
+	}
+	up := "down"
+	if status.Up {
+		up = "up"
+	}
+	c.table("FIELD\tVALUE", [][]string{
+		{"interface", status.Interface},
+		{"state", up},
+		{"endpoint", status.Endpoint},
+		{"listen port", status.ListenPort},
+		{"public key", status.PublicKey},
+		{"clients", strconv.Itoa(status.Clients)},
+		{"active", strconv.Itoa(status.Active)},
+		{"online", strconv.Itoa(status.Online)},
+	})
+	return nil
+}
+
+func (c *command) client(args []string) error {
+	if len(args) == 0 {
+		return usageError("client: subcommand is required")
+	}
+	switch args[0] {
+	case "add":
+		return c.clientAdd(args[1:])
+	case "list":
+		return c.clientList(args[1:])
+	case "show":
+		return c.clientShow(args[1:])
+	case "stop":
+		return c.clientAction(args[1:], "stop", http.MethodPatch, "/stopClient")
+	case "start":
+		return c.clientAction(args[1:], "start", http.MethodPatch, "/activateClient")
+	case "delete":
+		return c.clientAction(args[1:], "delete", http.MethodDelete, "/deleteClient")
+	case "config":
+		return c.clientConfig(args[1:])
+	case "contact":
+		return c.clientContact(args[1:])
+	default:
+		return usageError("client: unknown subcommand %q", args[0])
+	}
+}
+
+func (c *command) clientAdd(args []string) error {
+	fs := c.flags("client add")
+	name := fs.String("name", "", "имя клиента")
+	plan := fs.Bool("plan", false, "показать план без изменений")
+	id, err := clientID(fs, args)
+	if err != nil {
+		return err
+	}
+	if *plan {
+		return c.showPlan(http.MethodPost, "/addClient", map[string]interface{}{"id": id, "name": *name})
+	}
+
+	data, err := c.api.do(http.MethodPost, "/addClient", map[string]interface{}{"id": id, "name": *name})
+	if err != nil {
+		return err
+	}
+	var resp struct {
+		Client wg.Client `json:"client"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return err
+	}
+	if c.jsonOut {
+		return c.printJSON(resp.Client.Info(time.Now()))
+	}
+	fmt.Fprintf(c.out, "client %d added, address %s\n", resp.Client.Id, resp.Client.AddressClient)
+	return nil
+}
+
+func (c *command) clientList(args []string) error {
+	if _, err := parseArgs(c.flags("client list"), args); err != nil {
+		return err
+	}
+	var resp struct {
+		Clients []wg.ClientInfo `json:"clients"`
+	}
+	if err := c.api.getJSON("/api/v1/clients", &resp); err != nil {
+		return err
+	}
+	if c.jsonOut {
+		return c.printJSON(resp.Clients)
+	}
+	var rows [][]string
+	for _, client := range resp.Clients {
+		rows = append(rows, []string{strconv.Itoa(client.Id), client.Name, statusText(client.Status),
+			client.AddressClient, client.Presence, formatTime(client.LastSeen)})
+	}
+	c.table("ID\tNAME\tSTATUS\tADDRESS\tPRESENCE\tLAST SEEN", rows)
+	return nil
+}
+
+// Сведения о клиенте, ошибка exitNotFound если его нет
+func (c *command) fetchClient(id int) (wg.ClientInfo, error) {
+	var info wg.ClientInfo
+	err := c.api.getJSON(fmt.Sprintf("/api/v1/clients/%d", id), &info)
+	return info, err
+}
+
+func (c *command) clientShow(args []string) error {
+	id, err := clientID(c.flags("client show"), args)
+	if err != nil {
+		return err
+	}
+	info, err := c.fetchClient(id)
+	if err != nil {
+		return err
+	}
+	if c.jsonOut {
+		return c.printJSON(info)
+	}
+	c.table("FIELD\tVALUE", [][]string{
+		{"id", strconv.Itoa(info.Id)},
+		{"name", info.Name},
+		{"status", statusText(info.Status)},
+		{"address", info.AddressClient},
+		{"public key", info.PublicKey},
+		{"presence", info.Presence},
+		{"endpoint", info.Endpoint},
+		{"latest handshake", formatTime(info.LatestHandshake)},
+		{"first seen", formatTime(info.FirstSeen)},
+		{"last seen", formatTime(info.LastSeen)},
+	})
+	return nil
+}
+
+// Действие над клиентом через API
+func (c *command) clientAction(args []string, name, method, path string) error {
+	fs := c.flags("client " + name)
+	plan := fs.Bool("plan", false, "показать план без изменений")
+	id, err := clientID(fs, args)
+	if err != nil {
+		return err
+	}
+	if *plan {
+		return c.showPlan(method, path, map[string]int{"id": id})
+	}
+	if _, err := c.api.do(method, path, map[string]int{"id": id}); err != nil {
+		return err
+	}
+	if c.jsonOut {
+		return c.printJSON(map[string]interface{}{"id": id, "action": name, "ok": true})
+	}
+	fmt.Fprintf(c.out, "client %d: %s done\n", id, name)
+	return nil
+}
+
+// Контакты клиента. Метод API заменяет все поля, поэтому не заданные
+// флагами поля очищаются.
+func (c *command) clientContact(args []string) error {
+	fs := c.flags("client contact")
+	tgID := fs.Int("tg", 0, "Telegram ID")
+	email := fs.String("email", "", "адрес почты")
+	webhook := fs.String("webhook", "", "адрес webhook")
+	channels := fs.String("channels", "", "каналы уведомлений через запятую, пусто — все доступные")
+	plan := fs.Bool("plan", false, "показать план без изменений")
+	id, err := clientID(fs, args)
+	if err != nil {
+		return err
+	}
+	body := map[string]interface{}{
+		"tg_id":           *tgID,
+		"email":           *email,
+		"webhook_url":     *webhook,
+		"notify_channels": []string{},
+	}
+	if *channels != "" {
+		body["notify_channels"] = strings.Split(*channels, ",")
+	}
+	path := fmt.Sprintf("/api/v1/clients/%d/contact", id)
+	if *plan {
+		return c.showPlan(http.MethodPut, path, body)
+	}
+	if _, err := c.api.do(http.MethodPut, path, body); err != nil {
+		return err
+	}
+	if c.jsonOut {
+		return c.printJSON(map[string]interface{}{"id": id, "action": "contact", "ok": true})
+	}
+	fmt.Fprintf(c.out, "client %d: contact updated\n", id)
+	return nil
+}
+
+func (c *command) clientConfig(args []string) error {
+	fs := c.flags("client config")
+	format := fs.String("format", wg.ConfigFormatWgQuick, "формат: conf, networkmanager, networkd, openwrt, routeros, png, svg, zip")
+	qr := fs.Bool("qr", false, "показать QR-код в терминале")
+	ascii := fs.Bool("ascii", false, "QR-код символами ASCII")
+	output := fs.String("o", "", "файл для сохранения")
+	id, err := clientID(fs, args)
+	if err != nil {
+		return err
+	}
+	if *qr {
+		*format = wg.ConfigFormatWgQuick
+	}
+
+	data, err := c.api.do(http.MethodGet, fmt.Sprintf("/api/v1/clients/%d/config?format=%s", id, url.QueryEscape(*format)), nil)
+	if err != nil {
+		return err
+	}
+	if *qr {
+		text, err := wg.ConfigQRTerminal(wg.Client{Id: id, Config: string(data)}, *ascii)
+		if err != nil {
+			return err
+		}
+		data = []byte(text)
+	}
+	if *output != "" {
+		if err := os.WriteFile(*output, data, 0600); err != nil {
+			return err
+		}
+		fmt.Fprintf(c.out, "saved to %s\n", *output)
+		return nil
+	}
+	_, err = c.out.Write(data)
+	return err
+}
+
+func (c *command) usage(args []string) error {
+	fs := c.flags("usage")
+	id := fs.Int("client", 0, "id клиента, 0 — все клиенты по дням")
+	period := fs.String("period", "daily", "daily или monthly")
+	from := fs.String("from", "", "начало, YYYY-MM-DD")
+	to := fs.String("to", "", "конец, YYYY-MM-DD")
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	if *from != "" {
+		query.Set("from", *from)
+	}
+	if *to != "" {
+		query.Set("to", *to)
+	}
+	var rows []wg.UsageRow
+	if *id != 0 {
+		var resp struct {
+			Usage []wg.UsageRow `json:"usage"`
+		}
+		path := fmt.Sprintf("/api/v1/clients/%d/usage/%s?%s", *id, url.PathEscape(*period), query.Encode())
+		if err := c.api.getJSON(path, &resp); err != nil {
+			return err
+		}
+		rows = resp.Usage
+	} else {
+		query.Set("format", "json")
+		if err := c.api.getJSON("/api/v1/usage/export?"+query.Encode(), &rows); err != nil {
+			return err
+		}
+	}
+
+	if c.jsonOut {
+		if rows == nil {
+			rows = []wg.UsageRow{}
+		}
+		return c.printJSON(rows)
+	}
+	var table [][]string
+	for _, row := range rows {
+		table = append(table, []string{strconv.Itoa(row.ClientID), row.Period,
+			wg.FormatBytes(row.Rx), wg.FormatBytes(row.Tx), wg.FormatBytes(row.Total)})
+	}
+	c.table("CLIENT\tPERIOD\tRX\tTX\tTOTAL", table)
+	return nil
+}
+
+// Пароль резервной копии из файла или WGCTL_BACKUP_PASSPHRASE
+func backupPassphrase(file string) (string, error) {
+	if file == "" {
+		return os.Getenv("WGCTL_BACKUP_PASSPHRASE"), nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+func (c *command) backup(args []string) error {
+	fs := c.flags("backup")
+	output := fs.String("o", "", "файл архива, по умолчанию wg-backup-<время>.zip[.enc]")
+	passphraseFile := fs.String("passphrase-file", "", "файл с паролем шифрования")
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+	passphrase, err := backupPassphrase(*passphraseFile)
+	if err != nil {
+		return err
+	}
+	if *output == "" {
+		*output = wg.BackupFileName(time.Now(), passphrase != "")
+	}
+
+	header := http.Header{}
+	if passphrase != "" {
+		header.Set("X-Backup-Passphrase", passphrase)
+	}
+	data, err := c.api.send(http.MethodGet, "/api/v1/backup", nil, header)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(*output, data, 0600); err != nil {
+		return err
+	}
+	if c.jsonOut {
+		return c.printJSON(map[string]interface{}{"file": *output, "size": len(data), "encrypted": passphrase != ""})
+	}
+	fmt.Fprintf(c.out, "backup saved to %s (%d bytes)\n", *output, len(data))
+	return nil
+}
+
+func (c *command) restore(args []string) error {
+	fs := c.flags("restore")
+	passphraseFile := fs.String("passphrase-file", "", "файл с паролем шифрования")
+	force := fs.Bool("force", false, "перезаписать настроенный сервер")
+	plan := fs.Bool("plan", false, "только проверить архив")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError("restore: expected backup file")
+	}
+	archive, err := os.ReadFile(positional[0])
+	if err != nil {
+		return err
+	}
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	if wg.BackupEncrypted(archive) {
+		passphrase, err := backupPassphrase(*passphraseFile)
+		if err != nil {
+			return err
+		}
+		if passphrase == "" {
+			return usageError("restore: backup is encrypted, use -passphrase-file or WGCTL_BACKUP_PASSPHRASE")
+		}
+		header.Set("X-Backup-Passphrase", passphrase)
+	}
+
+	query := url.Values{}
+	if *force {
+		query.Set("force", "true")
+	}
+	if *plan {
+		query.Set("plan", "true")
+	}
+	data, err := c.api.send(http.MethodPost, "/api/v1/restore?"+query.Encode(), bytes.NewReader(archive), header)
+	if err != nil {
+		return err
+	}
+	var report wg.RestoreReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		return err
+	}
+	if c.jsonOut {
+		return c.printJSON(report)
+	}
+	m := report.Manifest
+	fmt.Fprintf(c.out, "backup of %s from %s, format %d, %d clients\n", m.Hostname, formatTime(m.CreatedAt), m.Version, m.Server.Clients)
+	verb := "restored"
+	if report.DryRun {
+		verb = "would restore"
+	}
+	for _, path := range report.Files {
+		fmt.Fprintf(c.out, "%s %s\n", verb, path)
+	}
+	for _, warning := range report.Warnings {
+		fmt.Fprintf(c.out, "warning: %s\n", warning)
+	}
+	return nil
+}
+
+func (c *command) importInstall(args []string) error {
+	fs := c.flags("import")
+	path := fs.String("path", "", "файл или каталог источника на сервере")
+	plan := fs.Bool("plan", false, "показать отчёт без сохранения")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError("import: expected source")
+	}
+
+	query := url.Values{}
+	if *path != "" {
+		query.Set("path", *path)
+	}
+	if *plan {
+		query.Set("plan", "true")
+	}
+	data, err := c.api.do(http.MethodPost, "/api/v1/import/"+url.PathEscape(positional[0])+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	var report wg.ImportReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		return err
+	}
+	if c.jsonOut {
+		return c.printJSON(report)
+	}
+
+	rows := make([][]string, 0, len(report.Imported))
+	for _, client := range report.Imported {
+		privateKey := "no"
+		if client.HasPrivateKey {
+			privateKey = "yes"
+		}
+		rows = append(rows, []string{strconv.Itoa(client.Id), client.Name, client.Address, statusText(client.Enabled), privateKey})
+	}
+	c.table("ID\tNAME\tADDRESS\tSTATUS\tPRIVATE KEY", rows)
+	for _, skipped := range report.Skipped {
+		fmt.Fprintf(c.out, "skipped %s: %s\n", skipped.Item, skipped.Reason)
+	}
+	for _, warning := range report.Warnings {
+		fmt.Fprintf(c.out, "warning: %s\n", warning)
+	}
+	if report.DryRun {
+		fmt.Fprintln(c.out, "dry run, nothing saved")
+	}
+	return nil
+}
+
+func (c *command) drift(args []string) error {
+	fs := c.flags("drift")
+	repair := fs.Bool("repair", false, "привести хост к сохранённому состоянию")
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+	var report wg.DriftReport
+	if *repair {
+		data, err := c.api.do(http.MethodPost, "/api/v1/drift/reconcile", nil)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &report); err != nil {
+			return err
+		}
+	} else if err := c.api.getJSON("/api/v1/drift", &report); err != nil {
+		return err
+	}
+	if c.jsonOut {
+		return c.printJSON(report)
+	}
+	fmt.Fprint(c.out, report.Text())
+	fmt.Fprint(c.out, report.ConfigDiff)
+	return nil
+}
+
+// Политика простоя: показ или изменение. Не заданные флагами поля
+// берутся из текущей политики.
+func (c *command) inactivity(args []string) error {
+	if len(args) > 0 && args[0] == "set" {
+		return c.inactivitySet(args[1:])
+	}
+	if _, err := parseArgs(c.flags("inactivity"), args); err != nil {
+		return err
+	}
+	var policy wg.InactivityPolicy
+	if err := c.api.getJSON("/api/v1/inactivity/policy", &policy); err != nil {
+		return err
+	}
+	return c.printPolicy(policy)
+}
+
+func (c *command) inactivitySet(args []string) error {
+	fs := c.flags("inactivity set")
+	days := fs.Int("days", 0, "срок простоя в днях, 0 — политика отключена")
+	action := fs.String("action", "", "flag или stop")
+	enforce := fs.Bool("enforce", false, "выполнять действие, а не только отчёт")
+	plan := fs.Bool("plan", false, "показать план без изменений")
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+	var policy wg.InactivityPolicy
+	if err := c.api.getJSON("/api/v1/inactivity/policy", &policy); err != nil {
+		return err
+	}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "days":
+			policy.Days = *days
+		case "action":
+			policy.Action = *action
+		case "enforce":
+			policy.Enforce = *enforce
+		}
+	})
+	if err := policy.Validate(); err != nil {
+		return usageError("inactivity set: %v", err)
+	}
+	if *plan {
+		return c.showPlan(http.MethodPut, "/api/v1/inactivity/policy", policy)
+	}
+	data, err := c.api.do(http.MethodPut, "/api/v1/inactivity/policy", policy)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return err
+	}
+	return c.printPolicy(policy)
+}
+
+func (c *command) printPolicy(policy wg.InactivityPolicy) error {
+	if c.jsonOut {
+		return c.printJSON(policy)
+	}
+	action := policy.Action
+	if action == "" {
+		action = wg.InactivityActionFlag
+	}
+	c.table("FIELD\tVALUE", [][]string{
+		{"days", strconv.Itoa(policy.Days)},
+		{"action", action},
+		{"enforce", strconv.FormatBool(policy.Enforce)},
+	})
+	return nil
+}
+
+func (c *command) teardown(args []string) error {
+	fs := c.flags("teardown")
+	yes := fs.Bool("yes", false, "подтверждение удаления")
+	noBackup := fs.Bool("no-backup", false, "не сохранять резервную копию")
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+	if !*yes {
+		return usageError("teardown: confirm with -yes")
+	}
+
+	path := "/api/v1/server/teardown"
+	if *noBackup {
+		path += "?backup=false"
+	}
+	data, err := c.api.do(http.MethodPost, path, nil)
+	if err != nil {
+		return err
+	}
+	var report struct {
+		Backup  string     `json:"backup"`
+		Warning string     `json:"warning,omitempty"`
+		Journal wg.Journal `json:"journal"`
+	}
+	if err := json.Unmarshal(data, &report); err != nil {
+		return err
+	}
+	if c.jsonOut {
+		return c.printJSON(report)
+	}
+	rows := make([][]string, 0, len(report.Journal.Entries))
+	for _, entry := range report.Journal.Entries {
+		rows = append(rows, []string{entry.Step, entry.Status, entry.Error})
+	}
+	c.table("STEP\tSTATUS\tDETAIL", rows)
+	if report.Backup != "" {
+		fmt.Fprintf(c.out, "backup saved to %s\n", report.Backup)
+	}
+	if report.Warning != "" {
+		fmt.Fprintf(c.out, "warning: %s\n", report.Warning)
+	}
+	return nil
+}
+
+// Запрос плана операции (?plan=true) и вывод diff и команд
+func (c *command) showPlan(method, path string, body interface{}) error {
+	data, err := c.api.do(method, path+"?plan=true", body)
+	if err != nil {
+		return err
+	}
+	var plan wg.Plan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return err
+	}
+	if c.jsonOut {
+		return c.printJSON(plan)
+	}
+	if len(plan.Diffs) == 0 && len(plan.Commands) == 0 {
+		fmt.Fprintf(c.out, "%s: no changes\n", plan.Operation)
+		return nil
+	}
+	for _, diff := range plan.Diffs {
+		fmt.Fprint(c.out, diff.Diff)
+	}
+	if len(plan.Commands) > 0 {
+		fmt.Fprintln(c.out, "commands:")
+		for _, command := range plan.Commands {
+			fmt.Fprintf(c.out, "  %s\n", command)
+		}
+	}
+	for _, note := range plan.Notes {
+		fmt.Fprintf(c.out, "note: %s\n", note)
+	}
+	return nil
+}
+
+// Файл токена wgctl, который создаёт wgmanager в каталоге состояния
+const defaultTokenFile = "/etc/wireguard/cli_token"
+
+// Токен API из WGCTL_TOKEN или файла. Отсутствующий файл по умолчанию не
+// ошибка: демон ответит 401.
+func apiToken(file string, explicit bool) (string, error) {
+	if token := os.Getenv("WGCTL_TOKEN"); token != "" {
+		return token, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) && !explicit {
+			return "", nil
+		}
+		return "", &cliError{exitUsage, fmt.Sprintf("failed to read token: %v", err)}
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Пользователь ОС для журнала аудита демона
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return strconv.Itoa(os.Getuid())
+}
+
+func main() {
+	apiURL := os.Getenv("WGCTL_API")
+	if apiURL == "" {
+		apiURL = "http://127.0.0.1:8080"
+	}
+
+	fs := flag.NewFlagSet("wgctl", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.StringVar(&apiURL, "api", apiURL, "адрес API демона")
+	tokenFile := fs.String("token-file", defaultTokenFile, "файл токена API")
+	jsonOut := fs.Bool("json", false, "вывод в JSON")
+	if err := fs.Parse(os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			fmt.Print(usageText)
+			os.Exit(exitOK)
+		}
+		fmt.Fprintf(os.Stderr, "wgctl: %v\n\n%s", err, usageText)
+		os.Exit(exitUsage)
+	}
+
+	explicit := false
+	fs.Visit(func(f *flag.Flag) { explicit = explicit || f.Name == "token-file" })
+	token, err := apiToken(*tokenFile, explicit)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "wgctl: %v\n", err)
+		os.Exit(exitUsage)
+	}
+
+	c := &command{
+		api: &apiClient{
+			base:   strings.TrimRight(apiURL, "/"),
+			token:  token,
+			user:   currentUser(),
+			client: &http.Client{Timeout: 60 * time.Second},
+		},
+		jsonOut: *jsonOut,
+		out:     os.Stdout,
+	}
+	err = c.run(fs.Args())
+	if err == nil {
+		os.Exit(exitOK)
+	}
+
+	code := exitError
+	var ce *cliError
+	if errors.As(err, &ce) {
+		code = ce.code
+	}
+	if c.jsonOut {
+		json.NewEncoder(os.Stderr).Encode(map[string]interface{}{"error": err.Error(), "code": code})
+	} else {
+		fmt.Fprintf(os.Stderr, "wgctl: %v\n", err)
+		if code == exitUsage {
+			fmt.Fprint(os.Stderr, "\n"+usageText)
+		}
+	}
+	os.Exit(code)
+}
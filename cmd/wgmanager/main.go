@@ -0,0 +1,86 @@
+// wgmanager — демон управления сервером WireGuard: API, Telegram бот и фоновые задачи.
+//
+// Настройки берутся из файла (-config, YAML или TOML по расширению), затем
+// переопределяются переменными окружения и флагами:
+//
+//	WGMANAGER_LISTEN, WGMANAGER_STATE_DIR, WGMANAGER_API_TOKEN, WGMANAGER_BOT_TOKEN,
+//	WGMANAGER_SMTP_PASSWORD
+//
+// SIGTERM и SIGINT останавливают демон после завершения текущих запросов.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+
+	wg "wireguard_go_ubuntu"
+)
+
+// Чтение файла настроек
+func loadConfig(path string) (wg.DaemonConfig, error) {
+	var cfg wg.DaemonConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &cfg)
+	case ".toml":
+		err = toml.Unmarshal(data, &cfg)
+	default:
+		return cfg, fmt.Errorf("unknown config format: %s (use .yaml, .yml or .toml)", path)
+	}
+	if err != nil {
+		return cfg, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// Переопределение строки переменной окружения
+func envOverride(value *string, name string) {
+	if v, ok := os.LookupEnv(name); ok {
+		*value = v
+	}
+}
+
+func main() {
+	configPath := flag.String("config", "", "файл настроек (.yaml, .yml или .toml)")
+	listen := flag.String("listen", "", "адрес API, например 127.0.0.1:8080")
+	stateDir := flag.String("state-dir", "", "каталог файлов состояния")
+	flag.Parse()
+
+	var cfg wg.DaemonConfig
+	if *configPath != "" {
+		var err error
+		if cfg, err = loadConfig(*configPath); err != nil {
+			log.Fatalf("Ошибка чтения настроек: %v", err)
+		}
+	}
+	envOverride(&cfg.Listen, "WGMANAGER_LISTEN")
+	envOverride(&cfg.StateDir, "WGMANAGER_STATE_DIR")
+	envOverride(&cfg.APIToken, "WGMANAGER_API_TOKEN")
+	envOverride(&cfg.BotToken, "WGMANAGER_BOT_TOKEN")
+	envOverride(&cfg.SMTPPassword, "WGMANAGER_SMTP_PASSWORD")
+	if *listen != "" {
+		cfg.Listen = *listen
+	}
+	if *stateDir != "" {
+		cfg.StateDir = *stateDir
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	if err := wg.Serve(ctx, cfg); err != nil {
+		log.Fatalf("Ошибка сервера: %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+package wireguard_go_ubuntu
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"time"
+)
+
+// Инструкция по подключению, кладётся в архив с конфигурацией
+const setupInstructions = `Подключение к WireGuard
+
+Телефон (Android, iOS):
+  1. Установите приложение WireGuard.
+  2. Нажмите "+" и выберите "Сканировать QR-код".
+  3. Отсканируйте qr.png.
+
+Компьютер (Windows, macOS):
+  1. Установите WireGuard с https://www.wireguard.com/install/
+  2. Выберите "Импорт туннеля из файла" и укажите %[1]s.
+
+Linux:
+  sudo cp %[1]s /etc/wireguard/
+  sudo wg-quick up %[2]s
+`
+
+// Имя файла конфигурации клиента. Приложения берут имя туннеля из имени файла,
+// а имя интерфейса Linux ограничено 15 символами.
+func ConfigFileName(client Client) string {
+	return fmt.Sprintf("wgclient%d.conf", client.Id)
+}
+
+// Архив с конфигурацией, QR-кодом и инструкцией по подключению
+func ConfigBundle(client Client) ([]byte, error) {
+	png, err := ConfigQRPNG(client, DefaultQRSize)
+	if err != nil {
+		return nil, err
+	}
+	name := ConfigFileName(client)
+	iface := name[:len(name)-len(".conf")]
+
+	return zipFiles([]ConfigFile{
+		{name, []byte(client.Config)},
+		{"qr.png", png},
+		{"README.txt", []byte(fmt.Sprintf(setupInstructions, name, iface))},
+	})
+}
+
+// Упаковка файлов в zip архив
+func zipFiles(files []ConfigFile) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	now := time.Now()
+	for _, f := range files {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: f.Name, Method: zip.Deflate, Modified: now})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(f.Data); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,247 @@
+package wireguard_go_ubuntu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultListenAddr = "127.0.0.1:8080"
+	DefaultStateDir   = "/etc/wireguard"
+	// Сколько ждать завершения запросов при остановке
+	shutdownTimeout = 30 * time.Second
+)
+
+// Настройки демона. Пустые поля не меняют сохранённое состояние.
+type DaemonConfig struct {
+	Listen        string            `yaml:"listen" toml:"listen"`
+	APIToken      string            `yaml:"api_token" toml:"api_token"` // токен Bearer для интеграций, пусто — API доступен только wgctl
+	StateDir      string            `yaml:"state_dir" toml:"state_dir"` // каталог файлов состояния, журналов и очередей
+	BotToken      string            `yaml:"bot_token" toml:"bot_token"`
+	AdminTgIds    []int             `yaml:"admin_tg_ids" toml:"admin_tg_ids"`
+	SMTPPassword  string            `yaml:"smtp_password" toml:"smtp_password"`
+	Webhooks      []WebhookEndpoint `yaml:"webhooks" toml:"webhooks"`
+	AutoReconcile bool              `yaml:"auto_reconcile" toml:"auto_reconcile"` // периодическая сверка исправляет расхождения, а не только сообщает о них
+	Backup        BackupSchedule    `yaml:"backup" toml:"backup"`
+}
+
+// Плановые резервные копии
+type BackupSchedule struct {
+	IntervalHours int    `yaml:"interval_hours" toml:"interval_hours"` // 0 — плановые копии выключены
+	Keep          int    `yaml:"keep" toml:"keep"`                     // сколько последних копий хранить, 0 — 7
+	Dir           string `yaml:"dir" toml:"dir"`                       // каталог копий, пусто — backups в каталоге состояния
+	Passphrase    string `yaml:"passphrase" toml:"passphrase"`         // пароль шифрования, пусто — без шифрования
+}
+
+// Копий по умолчанию при плановом резервном копировании
+const defaultBackupKeep = 7
+
+// Пути файлов состояния в каталоге dir
+func setStateDir(dir string) {
+	stateFile = filepath.Join(dir, "wg_state.json")
+	trafficHistoryFile = filepath.Join(dir, "traffic_history.json")
+	sessionsFile = filepath.Join(dir, "sessions.json")
+	webhookQueueFile = filepath.Join(dir, "webhook_queue.json")
+	auditLogFile = filepath.Join(dir, "audit.log")
+}
+
+// Перенос настроек демона в конфигурацию сервера
+func (c DaemonConfig) apply(wg *WireGuardConfig) {
+	if c.BotToken != "" {
+		wg.BotToken = c.BotToken
+	}
+	if len(c.AdminTgIds) > 0 {
+		wg.AdminTgIds = c.AdminTgIds
+	}
+	if c.SMTPPassword != "" {
+		wg.Notify.SMTPPassword = c.SMTPPassword
+	}
+	if c.Webhooks != nil {
+		wg.Webhooks = c.Webhooks
+	}
+}
+
+// Маршруты API
+func apiRoutes() map[string]http.HandlerFunc {
+	return map[string]http.HandlerFunc{
+		"/addClient":                          AddClientHandler,
+		"/deleteClient":                       DeleteClientHandler,
+		"/getAllClients":                      GetAllClientsHandler,
+		"/activateClient":                     ActivateClientHandler,
+		"/stopClient":                         StopClientHandler,
+		"/startServer":                        StartServerHandler,
+		"/api/v1/clients":                     ListClientsHandler,
+		"/api/v1/clients/{id}":                GetClientHandler,
+		"/api/v1/clients/{id}/usage/{period}": ClientUsageHandler,
+		"/api/v1/clients/{id}/sessions":       ClientSessionsHandler,
+		"/api/v1/clients/{id}/tglink":         ClientTgLinkHandler,
+		"/api/v1/clients/{id}/qr":             ClientQRHandler,
+		"/api/v1/clients/{id}/config":         ClientConfigHandler,
+		"/api/v1/clients/{id}/contact":        ClientContactHandler,
+		"/api/v1/clients/{id}/deliver":        DeliverConfigHandler,
+		"/api/v1/usage/export":                UsageExportHandler,
+		"/api/v1/inactivity/policy":           InactivityPolicyHandler,
+		"/api/v1/inactivity/report":           InactivityReportHandler,
+		"/api/v1/inactivity/run":              InactivityRunHandler,
+		"/api/v1/webhooks/deliveries":         WebhookDeliveriesHandler,
+		"/api/v1/audit":                       AuditLogHandler,
+		"/api/v1/audit/verify":                AuditVerifyHandler,
+		"/api/v1/status":                      StatusHandler,
+		"/api/v1/backup":                      BackupHandler,
+		"/api/v1/restore":                     RestoreHandler,
+		"/api/v1/server/teardown":             TeardownHandler,
+		"/api/v1/journal":                     JournalHandler,
+		"/api/v1/drift":                       DriftReportHandler,
+		"/api/v1/drift/reconcile":             ReconcileHandler,
+		"/api/v1/import/{source}":             ImportHandler,
+	}
+}
+
+// Загрузка сохранённых данных из каталога состояния. Если состояние не
+// загрузилось, демон не запускается: иначе первое сохранение затёрло бы файл.
+func loadState(cfg DaemonConfig) error {
+	clMu.Lock()
+	if err := cl.LoadFromFile(stateFile); err != nil {
+		clMu.Unlock()
+		return fmt.Errorf("failed to load state: %v", err)
+	}
+	// Мигрированное состояние записывается сразу, иначе каждый запуск
+	// повторял бы миграцию и оставлял новую копию .bak
+	if cl.migrated {
+		saveState()
+	}
+	cfg.apply(&cl)
+	if cl.SessionRetentionDays > 0 {
+		sessions.Retention = time.Duration(cl.SessionRetentionDays) * 24 * time.Hour
+	}
+	clMu.Unlock()
+
+	// С повреждённым журналом демон не запускается: действия без записи
+	// в журнал нарушили бы его полноту
+	if err := audit.Open(auditLogFile); err != nil {
+		return fmt.Errorf("failed to load audit log %s: %v", auditLogFile, err)
+	}
+	if err := webhooks.LoadFromFile(webhookQueueFile); err != nil {
+		log.Printf("Ошибка загрузки очереди webhook: %v", err)
+	}
+	if err := sessions.LoadFromFile(sessionsFile); err != nil {
+		log.Printf("Ошибка загрузки журнала сессий: %v", err)
+	}
+	if err := history.LoadFromFile(trafficHistoryFile); err != nil {
+		log.Printf("Ошибка загрузки истории трафика: %v", err)
+	}
+	return nil
+}
+
+// Сохранение всех данных перед остановкой
+func flushState() {
+	// Блокировка дожидается изменений конфигурации, которые ещё выполняются
+	clMu.Lock()
+	saveState()
+	clMu.Unlock()
+
+	if err := webhooks.SaveToFile(webhookQueueFile); err != nil {
+		log.Printf("Ошибка сохранения очереди webhook: %v", err)
+	}
+	if err := sessions.SaveToFile(sessionsFile); err != nil {
+		log.Printf("Ошибка сохранения журнала сессий: %v", err)
+	}
+	if err := history.SaveToFile(trafficHistoryFile); err != nil {
+		log.Printf("Ошибка сохранения истории трафика: %v", err)
+	}
+}
+
+// Запуск API, бота и фоновых задач. Блокирует до отмены ctx, затем
+// дожидается текущих запросов и изменений конфигурации и сохраняет состояние.
+func Serve(ctx context.Context, cfg DaemonConfig) error {
+	if cfg.Listen == "" {
+		cfg.Listen = DefaultListenAddr
+	}
+	if cfg.StateDir == "" {
+		cfg.StateDir = DefaultStateDir
+	}
+	setStateDir(cfg.StateDir)
+	if err := loadState(cfg); err != nil {
+		return err
+	}
+	token, err := loadCLIToken(filepath.Join(cfg.StateDir, cliTokenFileName))
+	if err != nil {
+		return err
+	}
+	apiToken, cliToken = cfg.APIToken, token
+	backupPassphrase = cfg.Backup.Passphrase
+
+	mux := http.NewServeMux()
+	for pattern, handler := range apiRoutes() {
+		mux.HandleFunc(pattern, metrics.Instrument(pattern, handler))
+	}
+	mux.HandleFunc("/metrics", MetricsHandler)
+
+	bgCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var tasks sync.WaitGroup
+	start := func(interval time.Duration, fn func()) {
+		tasks.Add(1)
+		go func() {
+			defer tasks.Done()
+			runEvery(bgCtx, interval, fn)
+		}()
+	}
+	start(trafficSampleInterval, sampleTraffic)
+	start(peerMonitorInterval, samplePeers)
+	start(inactivityInterval, func() { runInactivityCheck(Actor{Type: ActorSystem, ID: "inactivity"}) })
+	start(webhookInterval, dispatchWebhooks)
+	start(reconcileInterval, func() { periodicReconcile(cfg.AutoReconcile) })
+	if cfg.Backup.IntervalHours > 0 {
+		dir, keep := cfg.Backup.Dir, cfg.Backup.Keep
+		if dir == "" {
+			dir = filepath.Join(cfg.StateDir, "backups")
+		}
+		if keep <= 0 {
+			keep = defaultBackupKeep
+		}
+		start(time.Duration(cfg.Backup.IntervalHours)*time.Hour, func() { scheduledBackup(dir, keep, cfg.Backup.Passphrase) })
+	}
+
+	clMu.Lock()
+	botEnabled := cl.BotToken != ""
+	clMu.Unlock()
+	if botEnabled {
+		go func() {
+			if err := RunTelegramBot(); err != nil {
+				log.Printf("Ошибка запуска Telegram бота: %v", err)
+			}
+		}()
+	}
+
+	srv := &http.Server{Addr: cfg.Listen, Handler: requireAPIToken(mux)}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.ListenAndServe()
+	}()
+	log.Printf("API server started on %s", cfg.Listen)
+
+	select {
+	case <-ctx.Done():
+		log.Println("Остановка сервера")
+	case err = <-serveErr:
+		log.Printf("Ошибка HTTP сервера: %v", err)
+	}
+
+	shutdownCtx, stop := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer stop()
+	if serr := srv.Shutdown(shutdownCtx); serr != nil && !errors.Is(serr, http.ErrServerClosed) {
+		log.Printf("Ошибка остановки HTTP сервера: %v", serr)
+	}
+	StopTelegramBot()
+	cancel()
+	tasks.Wait()
+	flushState()
+	return err
+}
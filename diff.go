@@ -0,0 +1,137 @@
+package wireguard_go_ubuntu
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Строк контекста вокруг изменений
+const diffContext = 3
+
+// Строка сравнения: ' ' — общая, '-' — удалена, '+' — добавлена
+type diffLine struct {
+	kind byte
+	text string
+}
+
+// Построчный unified diff содержимого до и после. nil означает отсутствующий
+// файл (/dev/null). Пустая строка — изменений нет.
+func UnifiedDiff(name string, before, after []byte) string {
+	if string(before) == string(after) && (before == nil) == (after == nil) {
+		return ""
+	}
+	lines := diffLines(splitLines(string(before)), splitLines(string(after)))
+
+	var buf strings.Builder
+	from, to := "a/"+strings.TrimPrefix(name, "/"), "b/"+strings.TrimPrefix(name, "/")
+	if before == nil {
+		from = "/dev/null"
+	}
+	if after == nil {
+		to = "/dev/null"
+	}
+	fmt.Fprintf(&buf, "--- %s\n+++ %s\n", from, to)
+
+	// Номера строк до и после для каждой позиции
+	aPos, bPos := make([]int, len(lines)+1), make([]int, len(lines)+1)
+	for i, line := range lines {
+		aPos[i+1], bPos[i+1] = aPos[i], bPos[i]
+		if line.kind != '+' {
+			aPos[i+1]++
+		}
+		if line.kind != '-' {
+			bPos[i+1]++
+		}
+	}
+	for start := 0; start < len(lines); {
+		if lines[start].kind == ' ' {
+			start++
+			continue
+		}
+		// Границы фрагмента: изменения, между которыми не больше 2*diffContext общих строк
+		end := start
+		for i := start; i < len(lines) && i-end <= 2*diffContext; i++ {
+			if lines[i].kind != ' ' {
+				end = i
+			}
+		}
+		from := max(start-diffContext, 0)
+		to := min(end+diffContext+1, len(lines))
+		aStart, aCount := aPos[from]+1, aPos[to]-aPos[from]
+		bStart, bCount := bPos[from]+1, bPos[to]-bPos[from]
+		if aCount == 0 {
+			aStart--
+		}
+		if bCount == 0 {
+			bStart--
+		}
+		fmt.Fprintf(&buf, "@@ -%d,%d +%d,%d @@\n", aStart, aCount, bStart, bCount)
+		for _, line := range lines[from:to] {
+			buf.WriteByte(line.kind)
+			buf.WriteString(line.text)
+			buf.WriteByte('\n')
+		}
+		start = to
+	}
+	return buf.String()
+}
+
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// Сравнение через наибольшую общую подпоследовательность. Общие начало и конец
+// отбрасываются заранее: правки wg0.conf обычно затрагивают несколько строк.
+func diffLines(a, b []string) []diffLine {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	am, bm := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+
+	// lcs[i][j] — длина общей подпоследовательности am[i:] и bm[j:]
+	lcs := make([][]int, len(am)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bm)+1)
+	}
+	for i := len(am) - 1; i >= 0; i-- {
+		for j := len(bm) - 1; j >= 0; j-- {
+			if am[i] == bm[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	lines := make([]diffLine, 0, len(a)+len(b))
+	for _, text := range a[:prefix] {
+		lines = append(lines, diffLine{' ', text})
+	}
+	i, j := 0, 0
+	for i < len(am) || j < len(bm) {
+		switch {
+		case i < len(am) && j < len(bm) && am[i] == bm[j]:
+			lines = append(lines, diffLine{' ', am[i]})
+			i++
+			j++
+		case i < len(am) && (j == len(bm) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, diffLine{'-', am[i]})
+			i++
+		default:
+			lines = append(lines, diffLine{'+', bm[j]})
+			j++
+		}
+	}
+	for _, text := range a[len(a)-suffix:] {
+		lines = append(lines, diffLine{' ', text})
+	}
+	return lines
+}
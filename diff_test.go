@@ -0,0 +1,67 @@
+package wireguard_go_ubuntu
+
+import "testing"
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name          string
+		before, after []byte
+		want          string
+	}{
+		{
+			name:   "no changes",
+			before: []byte("a\nb\n"),
+			after:  []byte("a\nb\n"),
+			want:   "",
+		},
+		{
+			name:   "insert",
+			before: []byte("a\nb\nc\n"),
+			after:  []byte("a\nX\nb\nc\n"),
+			want:   "--- a/etc/x\n+++ b/etc/x\n@@ -1,3 +1,4 @@\n a\n+X\n b\n c\n",
+		},
+		{
+			name:   "delete",
+			before: []byte("a\nb\nc\n"),
+			after:  []byte("a\nc\n"),
+			want:   "--- a/etc/x\n+++ b/etc/x\n@@ -1,3 +1,2 @@\n a\n-b\n c\n",
+		},
+		{
+			name:   "replace",
+			before: []byte("a\nb\nc\n"),
+			after:  []byte("a\nB\nc\n"),
+			want:   "--- a/etc/x\n+++ b/etc/x\n@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n",
+		},
+		{
+			name:  "new file",
+			after: []byte("a\nb\n"),
+			want:  "--- /dev/null\n+++ b/etc/x\n@@ -0,0 +1,2 @@\n+a\n+b\n",
+		},
+		{
+			name:   "removed file",
+			before: []byte("a\nb\n"),
+			want:   "--- a/etc/x\n+++ /dev/null\n@@ -1,2 +0,0 @@\n-a\n-b\n",
+		},
+		{
+			name:   "empty file created",
+			before: nil,
+			after:  []byte{},
+			want:   "--- /dev/null\n+++ b/etc/x\n",
+		},
+		{
+			name:   "separate hunks",
+			before: []byte("1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n"),
+			after:  []byte("0\n1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n"),
+			want: "--- a/etc/x\n+++ b/etc/x\n" +
+				"@@ -1,3 +1,4 @@\n+0\n 1\n 2\n 3\n" +
+				"@@ -9,4 +10,3 @@\n 9\n 10\n 11\n-12\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := UnifiedDiff("/etc/x", tt.before, tt.after); got != tt.want {
+				t.Errorf("UnifiedDiff() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
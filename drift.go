@@ -0,0 +1,409 @@
+package wireguard_go_ubuntu
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Где найдено расхождение
+const (
+	DriftSourceState  = "state"  // PeerStr клиента описывает другой ключ
+	DriftSourceConfig = "config" // wg0.conf
+	DriftSourceDevice = "device" // работающий интерфейс wg0
+)
+
+// Виды расхождений
+const (
+	DriftMissing  = "missing"  // пира активного клиента нет
+	DriftExtra    = "extra"    // пир есть, но клиента нет в состоянии или он остановлен
+	DriftMismatch = "mismatch" // AllowedIPs или содержимое отличаются
+	DriftDown     = "down"     // интерфейс не поднят
+	DriftOverlap  = "overlap"  // AllowedIPs нескольких клиентов пересекаются, ядро отдаёт сеть последнему
+)
+
+// Расхождение состояния с wg0.conf или устройством
+type DriftIssue struct {
+	Source    string `json:"source"`
+	Kind      string `json:"kind"`
+	ClientID  int    `json:"client_id,omitempty"`
+	PublicKey string `json:"public_key,omitempty"`
+	Expected  string `json:"expected,omitempty"`
+	Actual    string `json:"actual,omitempty"`
+	Detail    string `json:"detail,omitempty"`
+	Known     bool   `json:"known,omitempty"` // известное расхождение: исправление его не устранит
+}
+
+// Отчёт сверки состояния, wg0.conf и устройства
+type DriftReport struct {
+	CheckedAt  time.Time    `json:"checked_at"`
+	InSync     bool         `json:"in_sync"` // нет расхождений, кроме известных
+	Issues     []DriftIssue `json:"issues"`
+	ConfigDiff string       `json:"config_diff,omitempty"` // wg0.conf относительно состояния, ключ сервера скрыт
+	Repaired   bool         `json:"repaired"`
+	Remaining  []DriftIssue `json:"remaining,omitempty"` // расхождения после исправления
+	Error      string       `json:"error,omitempty"`     // ошибка исправления
+}
+
+// Пир из секции [Peer] файла конфигурации
+type ConfPeer struct {
+	PublicKey  string `json:"public_key"`
+	AllowedIPs string `json:"allowed_ips"`
+}
+
+// Секции [Peer] конфигурации wg-quick
+func parseConfPeers(data string) []ConfPeer {
+	var peers []ConfPeer
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	inPeer := false
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") {
+			inPeer = strings.EqualFold(line, "[Peer]")
+			if inPeer {
+				peers = append(peers, ConfPeer{})
+			}
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !inPeer || !ok || strings.HasPrefix(line, "#") {
+			continue
+		}
+		peer := &peers[len(peers)-1]
+		switch strings.TrimSpace(key) {
+		case "PublicKey":
+			peer.PublicKey = strings.TrimSpace(value)
+		case "AllowedIPs":
+			peer.AllowedIPs = strings.TrimSpace(value)
+		}
+	}
+	return peers
+}
+
+// AllowedIPs в виде, который показывает wg: адреса сетей через запятую по порядку
+func normalizeAllowedIPs(value string) string {
+	var nets []string
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if _, ipNet, err := net.ParseCIDR(part); err == nil {
+			part = ipNet.String()
+		}
+		nets = append(nets, part)
+	}
+	sort.Strings(nets)
+	return strings.Join(nets, ",")
+}
+
+// Секция [Peer] клиента по его ключу и адресу
+func canonicalPeer(client Client) string {
+	if client.PresharedKey != "" {
+		return fmt.Sprintf("\n[Peer]\nPublicKey = %s\nPresharedKey = %s\nAllowedIPs = %s\n", client.PublicClientKey, client.PresharedKey, client.AddressClient)
+	}
+	return fmt.Sprintf("\n[Peer]\nPublicKey = %s\nAllowedIPs = %s\n", client.PublicClientKey, client.AddressClient)
+}
+
+// PeerStr пусто или описывает пира с ключом клиента. Импортированные пиры
+// хранят секцию целиком, с PresharedKey и прочими полями.
+func (client Client) peerStrValid() bool {
+	if client.PeerStr == "" {
+		return true
+	}
+	peers := parseConfPeers(client.PeerStr)
+	return len(peers) == 1 && peers[0].PublicKey == client.PublicClientKey
+}
+
+// AllowedIPs пира клиента в wg0.conf
+func (client Client) allowedIPs() string {
+	if client.PeerStr != "" && client.peerStrValid() {
+		return parseConfPeers(client.PeerStr)[0].AllowedIPs
+	}
+	return client.AddressClient
+}
+
+// Значение PresharedKey в секции [Peer]
+var presharedKeyLine = regexp.MustCompile(`(?m)^(\s*PresharedKey\s*=\s*)(\S+)`)
+
+// Скрытие приватных ключей keys и всех общих ключей в тексте конфигурации
+func maskPrivateKeys(data []byte, keys ...string) []byte {
+	if data == nil {
+		return nil
+	}
+	text := string(data)
+	for _, key := range keys {
+		if key != "" && key != plannedKey {
+			text = strings.ReplaceAll(text, key, "<private key>")
+		}
+	}
+	text = presharedKeyLine.ReplaceAllString(text, "${1}<preshared key>")
+	return []byte(text)
+}
+
+// Сверка состояния с wg0.conf и устройством. device — пиры из wg show,
+// nil — интерфейс не поднят. Ничего не меняет. Для ненастроенного сервера
+// сверять нечего.
+func (wg *WireGuardConfig) CheckDrift(now time.Time, device map[string]PeerStats) DriftReport {
+	report := DriftReport{CheckedAt: now, Issues: []DriftIssue{}}
+	if wg.PrivateKey == "" {
+		report.InSync = true
+		return report
+	}
+
+	// Ожидаемые пиры: активные клиенты по ключу и адресу
+	expected := map[string]string{}
+	owners := map[string]int{}
+	ids := make([]int, 0, len(wg.Clients))
+	for id := range wg.Clients {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		client := wg.Clients[id]
+		owners[client.PublicClientKey] = id
+		if !client.Status {
+			continue
+		}
+		expected[client.PublicClientKey] = normalizeAllowedIPs(client.allowedIPs())
+		if !client.peerStrValid() {
+			issue := DriftIssue{Source: DriftSourceState, Kind: DriftMismatch, ClientID: id, PublicKey: client.PublicClientKey,
+				Expected: client.PublicClientKey + " " + client.AddressClient}
+			if peers := parseConfPeers(client.PeerStr); len(peers) > 0 {
+				issue.Actual = peers[0].PublicKey + " " + peers[0].AllowedIPs
+			}
+			report.Issues = append(report.Issues, issue)
+		}
+	}
+	compare := func(source string, expected, actual map[string]string) {
+		for _, id := range ids {
+			key := wg.Clients[id].PublicClientKey
+			want, active := expected[key]
+			if !active || owners[key] != id {
+				continue
+			}
+			got, exists := actual[key]
+			switch {
+			case !exists:
+				report.Issues = append(report.Issues, DriftIssue{Source: source, Kind: DriftMissing, ClientID: id, PublicKey: key, Expected: want})
+			case got != want:
+				report.Issues = append(report.Issues, DriftIssue{Source: source, Kind: DriftMismatch, ClientID: id, PublicKey: key, Expected: want, Actual: got})
+			}
+		}
+		keys := make([]string, 0, len(actual))
+		for key := range actual {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if _, ok := expected[key]; !ok {
+				report.Issues = append(report.Issues, DriftIssue{Source: source, Kind: DriftExtra, ClientID: owners[key], PublicKey: key, Actual: actual[key]})
+			}
+		}
+	}
+
+	// wg0.conf: пиры и файл целиком относительно того, что записал бы applyConfig
+	fixed := wg.clone()
+	fixed.normalizePeers()
+	content, err := fixed.ServerConfig()
+	current, readErr := os.ReadFile(wgConfigFile)
+	switch {
+	case readErr != nil:
+		report.Issues = append(report.Issues, DriftIssue{Source: DriftSourceConfig, Kind: DriftMissing, Detail: readErr.Error()})
+	case err != nil:
+		report.Issues = append(report.Issues, DriftIssue{Source: DriftSourceConfig, Kind: DriftMismatch, Detail: err.Error()})
+	default:
+		before := len(report.Issues)
+		peers := map[string]string{}
+		for _, peer := range parseConfPeers(string(current)) {
+			peers[peer.PublicKey] = normalizeAllowedIPs(peer.AllowedIPs)
+		}
+		compare(DriftSourceConfig, expected, peers)
+		report.ConfigDiff = UnifiedDiff(wgConfigFile, maskPrivateKeys(current, wg.PrivateKey), maskPrivateKeys([]byte(content), wg.PrivateKey))
+		if report.ConfigDiff != "" && len(report.Issues) == before {
+			report.Issues = append(report.Issues, DriftIssue{Source: DriftSourceConfig, Kind: DriftMismatch, Detail: "wg0.conf differs from state, see config_diff"})
+		}
+	}
+
+	if device == nil {
+		report.Issues = append(report.Issues, DriftIssue{Source: DriftSourceDevice, Kind: DriftDown, Detail: "wg0 is not up"})
+	} else {
+		peers := map[string]string{}
+		for key, stats := range device {
+			peers[key] = normalizeAllowedIPs(stats.AllowedIPs)
+		}
+		onDevice, overlaps := wg.deviceAllowedIPs(ids)
+		report.Issues = append(report.Issues, overlaps...)
+		compare(DriftSourceDevice, onDevice, peers)
+	}
+
+	report.InSync = true
+	for _, issue := range report.Issues {
+		report.InSync = report.InSync && issue.Known
+	}
+	return report
+}
+
+// AllowedIPs активных клиентов в том виде, в каком их покажет wg show.
+// Сеть, указанная у нескольких пиров, в ядре остаётся только у последнего
+// по порядку wg0.conf; у остальных она пропадает, пир без сетей — (none).
+// Так выглядят клиенты старых версий с адресами 10.0.0.<id>/24: такие
+// пересечения возвращаются как известные расхождения, перезапуск их не
+// устраняет.
+func (wg *WireGuardConfig) deviceAllowedIPs(ids []int) (map[string]string, []DriftIssue) {
+	owner := map[string]int{}    // сеть -> клиент, у которого она в ядре
+	shared := map[string][]int{} // сеть -> все клиенты с ней
+	var prefixes []string
+	for _, id := range ids {
+		client := wg.Clients[id]
+		if !client.Status {
+			continue
+		}
+		for _, prefix := range strings.Split(normalizeAllowedIPs(client.allowedIPs()), ",") {
+			if prefix == "" {
+				continue
+			}
+			if _, ok := owner[prefix]; !ok {
+				prefixes = append(prefixes, prefix)
+			}
+			owner[prefix] = id
+			shared[prefix] = append(shared[prefix], id)
+		}
+	}
+
+	nets := map[string][]string{}
+	for _, prefix := range prefixes {
+		key := wg.Clients[owner[prefix]].PublicClientKey
+		nets[key] = append(nets[key], prefix)
+	}
+	result := map[string]string{}
+	for _, id := range ids {
+		client := wg.Clients[id]
+		if !client.Status {
+			continue
+		}
+		result[client.PublicClientKey] = "(none)"
+		if list := nets[client.PublicClientKey]; len(list) > 0 {
+			result[client.PublicClientKey] = normalizeAllowedIPs(strings.Join(list, ","))
+		}
+	}
+
+	var issues []DriftIssue
+	for _, prefix := range prefixes {
+		if len(shared[prefix]) < 2 {
+			continue
+		}
+		clients := make([]string, len(shared[prefix]))
+		for i, id := range shared[prefix] {
+			clients[i] = strconv.Itoa(id)
+		}
+		issues = append(issues, DriftIssue{Source: DriftSourceState, Kind: DriftOverlap, ClientID: owner[prefix], Known: true,
+			Detail: fmt.Sprintf("%s is set for clients %s, the kernel routes it to client %d only; give the clients /32 addresses", prefix, strings.Join(clients, ", "), owner[prefix])})
+	}
+	return result, issues
+}
+
+// Замена PeerStr, описывающих чужой ключ, секцией по ключу и адресу клиента
+func (wg *WireGuardConfig) normalizePeers() {
+	for id, client := range wg.Clients {
+		if !client.peerStrValid() {
+			client.PeerStr = canonicalPeer(client)
+			wg.Clients[id] = client
+		}
+	}
+}
+
+// Приведение хоста к состоянию по отчёту CheckDrift: исправление PeerStr,
+// запись wg0.conf и применение к интерфейсу. Расхождения пиров применяются
+// через wg syncconf без разрыва туннелей; перезапуск — только если
+// интерфейс не поднят или изменилась секция [Interface]. Известные
+// расхождения не применяются. При ошибке wg0.conf восстанавливается.
+func (wg *WireGuardConfig) Reconcile(report DriftReport) error {
+	defer metrics.ObserveApply(time.Now())
+	wg.normalizePeers()
+
+	j := NewJournal("reconcile")
+	active := wireguardActive()
+	previous, _ := os.ReadFile(wgConfigFile)
+	changed, err := wg.configStep(j, active)
+	if err != nil {
+		return applyFailed(j.Finish(err))
+	}
+	switch {
+	case !active:
+		err = restartStep(j)
+	case changed && interfaceChanged(previous):
+		err = restartStep(j)
+	case changed || report.hasSource(DriftSourceDevice):
+		err = syncStep(j)
+	}
+	return applyFailed(j.Finish(err))
+}
+
+// Есть расхождение из source, которое исправление может устранить
+func (report DriftReport) hasSource(source string) bool {
+	for _, issue := range report.Issues {
+		if issue.Source == source && !issue.Known {
+			return true
+		}
+	}
+	return false
+}
+
+// Секция [Interface] в wg0.conf отличается от previous. Её настройки wg-quick
+// (адрес, PostUp, MTU) применяются только перезапуском.
+func interfaceChanged(previous []byte) bool {
+	current, err := os.ReadFile(wgConfigFile)
+	if err != nil {
+		return true
+	}
+	return interfaceSection(string(previous)) != interfaceSection(string(current))
+}
+
+// Текст конфигурации до первой секции [Peer]
+func interfaceSection(data string) string {
+	if i := strings.Index(data, "[Peer]"); i >= 0 {
+		return data[:i]
+	}
+	return data
+}
+
+// Текст отчёта для уведомления администратора
+func (report DriftReport) Text() string {
+	var b strings.Builder
+	if len(report.Issues) == 0 {
+		return "Состояние, wg0.conf и устройство совпадают\n"
+	}
+	fmt.Fprintf(&b, "Найдено расхождений: %d\n", len(report.Issues))
+	for _, issue := range report.Issues {
+		fmt.Fprintf(&b, "%s %s", issue.Source, issue.Kind)
+		if issue.ClientID != 0 {
+			fmt.Fprintf(&b, " клиент %d", issue.ClientID)
+		}
+		if issue.PublicKey != "" {
+			fmt.Fprintf(&b, " ключ %s", issue.PublicKey)
+		}
+		if issue.Expected != "" || issue.Actual != "" {
+			fmt.Fprintf(&b, " ожидалось %q, найдено %q", issue.Expected, issue.Actual)
+		}
+		if issue.Detail != "" {
+			fmt.Fprintf(&b, ": %s", issue.Detail)
+		}
+		if issue.Known {
+			b.WriteString(" (известное, исправление не требуется)")
+		}
+		b.WriteString("\n")
+	}
+	if report.Repaired {
+		fmt.Fprintf(&b, "Исправлено, осталось расхождений: %d\n", len(report.Remaining))
+	} else if report.Error != "" {
+		fmt.Fprintf(&b, "Ошибка исправления: %s\n", report.Error)
+	}
+	return b.String()
+}
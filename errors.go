@@ -0,0 +1,74 @@
+package wireguard_go_ubuntu
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Ошибки методов сервера и клиентов; проверяются через errors.Is
+var (
+	ErrClientNotFound = errors.New("client not found")
+	ErrAlreadyActive  = errors.New("client is already active")
+	ErrAlreadyStopped = errors.New("client is already stopped")
+	ErrNoBotToken     = errors.New("telegram bot token is not set")
+	ErrNoTelegramID   = errors.New("client has no telegram id")
+	// Изменение не применилось на хосте; вывод упавшей команды — в CommandError
+	ErrApplyFailed = errors.New("apply failed")
+)
+
+func clientNotFound(id int) error {
+	return fmt.Errorf("%w: %d", ErrClientNotFound, id)
+}
+
+// Ошибка внешней команды с её выводом. Считается ErrApplyFailed.
+type CommandError struct {
+	Command string
+	Output  string
+	Err     error
+}
+
+func (e *CommandError) Error() string {
+	if e.Output != "" {
+		return fmt.Sprintf("%s: %v: %s", e.Command, e.Err, e.Output)
+	}
+	return fmt.Sprintf("%s: %v", e.Command, e.Err)
+}
+
+func (e *CommandError) Unwrap() error { return e.Err }
+
+func (e *CommandError) Is(target error) bool { return target == ErrApplyFailed }
+
+func commandError(name string, args []string, out []byte, err error) error {
+	return &CommandError{
+		Command: strings.TrimSpace(name + " " + strings.Join(args, " ")),
+		Output:  strings.TrimSpace(string(out)),
+		Err:     err,
+	}
+}
+
+// Ошибка применения изменения на хосте, если она ещё не помечена
+func applyFailed(err error) error {
+	if err == nil || errors.Is(err, ErrApplyFailed) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrApplyFailed, err)
+}
+
+// HTTP статус для ошибки методов сервера и клиентов; fallback — для
+// ошибок без типа
+func errorStatus(err error, fallback int) int {
+	switch {
+	case errors.Is(err, ErrClientNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrAlreadyActive), errors.Is(err, ErrAlreadyStopped):
+		return http.StatusConflict
+	case errors.Is(err, ErrNoBotToken), errors.Is(err, ErrNoTelegramID):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, ErrApplyFailed):
+		return http.StatusInternalServerError
+	default:
+		return fallback
+	}
+}
@@ -1,5 +1,12 @@
 module wireguard_go_ubuntu
 
-go 1.23
+go 1.23.0
 
-require gopkg.in/telebot.v3 v3.3.8 // indirect
+require gopkg.in/telebot.v3 v3.3.8
+
+require (
+	github.com/BurntSushi/toml v1.6.0
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	golang.org/x/crypto v0.36.0
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -0,0 +1,356 @@
+package wireguard_go_ubuntu
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Источники импорта
+const (
+	ImportWgQuick = "wg-quick"
+	ImportWgEasy  = "wg-easy"
+	ImportPiVPN   = "pivpn"
+)
+
+// Отчёт импорта: что перенесено и что перенести не удалось
+type ImportReport struct {
+	Source   string           `json:"source"`
+	DryRun   bool             `json:"dry_run"`
+	Imported []ImportedClient `json:"imported"`
+	Skipped  []ImportSkipped  `json:"skipped"`
+	Warnings []string         `json:"warnings"`
+}
+
+// Перенесённый клиент
+type ImportedClient struct {
+	Id            int    `json:"id"`
+	Name          string `json:"name"`
+	Address       string `json:"address"`
+	PublicKey     string `json:"public_key"`
+	HasPrivateKey bool   `json:"has_private_key"` // без приватного ключа конфигурацию клиента выдать нельзя
+	Enabled       bool   `json:"enabled"`
+}
+
+// Элемент, который не удалось перенести
+type ImportSkipped struct {
+	Item   string `json:"item"` // пир, пользователь или файл
+	Reason string `json:"reason"`
+}
+
+func newImportReport(source string) ImportReport {
+	return ImportReport{Source: source, Imported: []ImportedClient{}, Skipped: []ImportSkipped{}, Warnings: []string{}}
+}
+
+func (r *ImportReport) skip(item, format string, args ...interface{}) {
+	r.Skipped = append(r.Skipped, ImportSkipped{Item: item, Reason: fmt.Sprintf(format, args...)})
+}
+
+func (r *ImportReport) warn(format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+// Секция файла wg-quick: строки ключ = значение без комментариев и
+// комментарии, относящиеся к секции
+type confSection struct {
+	Lines    []string
+	Values   map[string]string
+	Comments []string
+}
+
+// Разбор wg-quick по секциям. Комментарии перед заголовком [Peer] и внутри
+// секции до первого ключа относятся к этой секции.
+func parseWgQuick(data string) (iface *confSection, peers []*confSection) {
+	var current *confSection
+	var pending []string
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";"):
+			pending = append(pending, line)
+		case strings.HasPrefix(line, "["):
+			current = &confSection{Values: map[string]string{}, Comments: pending}
+			pending = nil
+			if strings.EqualFold(line, "[Interface]") {
+				iface = current
+			} else if strings.EqualFold(line, "[Peer]") {
+				peers = append(peers, current)
+			}
+		case current != nil:
+			if len(current.Lines) == 0 {
+				current.Comments = append(current.Comments, pending...)
+				pending = nil
+			}
+			key, value, _ := strings.Cut(line, "=")
+			current.Values[strings.TrimSpace(key)] = strings.TrimSpace(value)
+			current.Lines = append(current.Lines, line)
+		}
+	}
+	return iface, peers
+}
+
+// Служебные комментарии, которые не являются именем, например "### end phone ###"
+var commentMarker = regexp.MustCompile(`(?i)^(end\b|begin\s*$)`)
+
+// Имя клиента из комментариев секции: "# phone", "### begin phone ###",
+// "# Client: phone", "# Name = phone"
+func commentName(comments []string) string {
+	for _, comment := range comments {
+		text := strings.Trim(comment, "#; \t")
+		if text == "" || commentMarker.MatchString(text) {
+			continue
+		}
+		lower := strings.ToLower(text)
+		for _, prefix := range []string{"begin ", "client:", "name:", "name =", "friendly_name =", "peer:"} {
+			if strings.HasPrefix(lower, prefix) {
+				text = strings.TrimSpace(text[len(prefix):])
+				break
+			}
+		}
+		if text != "" {
+			return text
+		}
+	}
+	return ""
+}
+
+// Номер клиента по адресу: смещение от начала сети интерфейса, как у
+// 10.0.0.<id> в сети по умолчанию. 0 — адрес вне сети интерфейса.
+func addressID(network *net.IPNet, allowedIPs string) int {
+	first, _, _ := strings.Cut(allowedIPs, ",")
+	ip, _, err := net.ParseCIDR(strings.TrimSpace(first))
+	if err != nil || network == nil || !network.Contains(ip) || ip.To4() == nil {
+		return 0
+	}
+	return int(ipv4Number(ip) - ipv4Number(network.IP))
+}
+
+func ipv4Number(ip net.IP) uint32 {
+	ip4 := ip.To4()
+	return uint32(ip4[0])<<24 | uint32(ip4[1])<<16 | uint32(ip4[2])<<8 | uint32(ip4[3])
+}
+
+// Интерфейс из правила MASQUERADE в PostUp
+var masqueradeIface = regexp.MustCompile(`POSTROUTING\s+-o\s+(\S+)\s+-j\s+MASQUERADE`)
+
+// Импорт существующей конфигурации wg-quick в пустое состояние: интерфейс
+// и пиры становятся сервером и клиентами. Секция [Interface] и поля пиров
+// сохраняются как были, поэтому собранный из состояния wg0.conf описывает
+// то же устройство и перезапуск не нужен. Имена берутся из комментариев,
+// номера — из адресов в сети интерфейса.
+func (wg *WireGuardConfig) ImportWgQuick(data string, now time.Time) (ImportReport, error) {
+	report := newImportReport(ImportWgQuick)
+	if err := wg.importWgQuick(data, now, &report); err != nil {
+		return report, err
+	}
+	report.addClients(wg.Clients)
+	return report, nil
+}
+
+func (wg *WireGuardConfig) importWgQuick(data string, now time.Time, report *ImportReport) error {
+	if err := wg.checkImportTarget(); err != nil {
+		return err
+	}
+	iface, peers := parseWgQuick(data)
+	if iface == nil || iface.Values["PrivateKey"] == "" {
+		return fmt.Errorf("no [Interface] section with PrivateKey")
+	}
+
+	wg.PrivateKey = iface.Values["PrivateKey"]
+	wg.ListenPort = iface.Values["ListenPort"]
+	wg.InterfaceConf = "[Interface]\n" + strings.Join(iface.Lines, "\n") + "\n"
+	var network *net.IPNet
+	if address := iface.Values["Address"]; address != "" {
+		first, _, _ := strings.Cut(address, ",")
+		if _, ipNet, err := net.ParseCIDR(strings.TrimSpace(first)); err == nil {
+			wg.Address, network = strings.TrimSpace(first), ipNet
+		} else {
+			report.warn("invalid interface Address %q, client ids are assigned in order", address)
+		}
+	}
+	if m := masqueradeIface.FindStringSubmatch(iface.Values["PostUp"]); m != nil {
+		wg.InterName = m[1]
+	}
+	if publicKey, err := publicKeyFor(wg.PrivateKey); err == nil {
+		wg.PublicKey = publicKey
+	} else {
+		report.warn("failed to derive server public key: %v", err)
+	}
+	if wg.ListenPort == "" {
+		report.warn("interface has no ListenPort, the kernel picks a random port on each start")
+	}
+	wg.detectEndpoint(report)
+
+	var clients []Client
+	seen := map[string]bool{}
+	for i, peer := range peers {
+		key := peer.Values["PublicKey"]
+		item := fmt.Sprintf("peer %d", i+1)
+		if name := commentName(peer.Comments); name != "" {
+			item = fmt.Sprintf("peer %d (%s)", i+1, name)
+		}
+		if key == "" {
+			report.skip(item, "no PublicKey")
+			continue
+		}
+		if seen[key] {
+			report.skip(item, "duplicate PublicKey %s", key)
+			continue
+		}
+		seen[key] = true
+		if peer.Values["AllowedIPs"] == "" {
+			report.skip(item, "no AllowedIPs")
+			continue
+		}
+
+		first, _, _ := strings.Cut(peer.Values["AllowedIPs"], ",")
+		client := Client{
+			Name:            commentName(peer.Comments),
+			Status:          true,
+			AddressClient:   strings.TrimSpace(first),
+			PublicClientKey: key,
+			PresharedKey:    peer.Values["PresharedKey"],
+			PeerStr:         "\n[Peer]\n" + strings.Join(peer.Lines, "\n") + "\n",
+			CreatedAt:       now,
+		}
+		client.Peer.PublicKey = wg.PublicKey
+		clients = append(clients, client)
+	}
+
+	wg.Clients = numberClients(network, clients, report)
+	wg.Provisioned = ProvisionRecord{At: now}
+	return nil
+}
+
+// Номера клиентов по адресам в сети интерфейса. Клиенты вне сети и с
+// занятым номером получают свободные номера после занятых.
+func numberClients(network *net.IPNet, list []Client, report *ImportReport) map[int]Client {
+	clients := map[int]Client{}
+	var unnumbered []Client
+	for _, client := range list {
+		id := addressID(network, client.AddressClient)
+		if _, taken := clients[id]; id <= 0 || taken {
+			unnumbered = append(unnumbered, client)
+			continue
+		}
+		client.Id = id
+		clients[id] = client
+	}
+	next := 1
+	for id := range clients {
+		next = max(next, id+1)
+	}
+	for _, client := range unnumbered {
+		client.Id = next
+		clients[next] = client
+		report.warn("client %d (%s): address %s is outside the interface network, id assigned in order", next, client.PublicClientKey, client.AddressClient)
+		next++
+	}
+	return clients
+}
+
+// Адрес сервера для конфигураций клиентов по сетевым интерфейсам хоста
+func (wg *WireGuardConfig) detectEndpoint(report *ImportReport) {
+	detected := WireGuardConfig{ListenPort: wg.ListenPort}
+	if err := detected.GetIPAndInterfaceName(); err != nil {
+		report.warn("failed to detect server endpoint: %v", err)
+		return
+	}
+	wg.Endpoint = detected.Endpoint
+	if wg.InterName == "" {
+		wg.InterName = detected.InterName
+	}
+}
+
+// Импорт возможен только в ненастроенное состояние
+func (wg *WireGuardConfig) checkImportTarget() error {
+	if wg.PrivateKey != "" || len(wg.Clients) > 0 {
+		return fmt.Errorf("state already has a server or clients, import needs an empty state")
+	}
+	return nil
+}
+
+// Перенесённые клиенты в отчёт по возрастанию id
+func (r *ImportReport) addClients(clients map[int]Client) {
+	ids := make([]int, 0, len(clients))
+	for id := range clients {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		client := clients[id]
+		r.Imported = append(r.Imported, ImportedClient{
+			Id:            id,
+			Name:          client.Name,
+			Address:       client.AddressClient,
+			PublicKey:     client.PublicClientKey,
+			HasPrivateKey: client.PrivateClientKey != "",
+			Enabled:       client.Status,
+		})
+		if client.PrivateClientKey == "" {
+			r.warn("client %d: no private key, its config cannot be downloaded or sent", id)
+		}
+	}
+}
+
+// Перезапись wg0.conf из импортированного состояния без перезапуска: файл
+// описывает уже работающее устройство. Исходный файл сохраняется рядом
+// с суффиксом .pre-import.
+func (wg *WireGuardConfig) TakeOverConfig() error {
+	defer metrics.ObserveApply(time.Now())
+	original, err := os.ReadFile(wgConfigFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if original != nil {
+		if err := os.WriteFile(wgConfigFile+".pre-import", original, 0600); err != nil {
+			return err
+		}
+	}
+	_, err = wg.GenerateWireGuardConfig()
+	return err
+}
+
+// Импорт читает работающий wg0.conf, который можно переписать через TakeOverConfig
+func ImportTakesOver(source, path string) bool {
+	switch source {
+	case ImportWgQuick:
+		return path == "" || path == wgConfigFile
+	case ImportPiVPN:
+		return path == "" || filepath.Join(path, "wg0.conf") == wgConfigFile
+	default:
+		return false
+	}
+}
+
+// Импорт из установки source, path — файл или каталог источника, пусто — путь по умолчанию
+func (wg *WireGuardConfig) ImportFrom(source, path string, now time.Time) (ImportReport, error) {
+	switch source {
+	case ImportWgQuick:
+		if path == "" {
+			path = wgConfigFile
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return newImportReport(source), err
+		}
+		return wg.ImportWgQuick(string(data), now)
+	case ImportWgEasy:
+		return wg.importWgEasyPath(path, now)
+	case ImportPiVPN:
+		if path == "" {
+			path = piVPNDir
+		}
+		return wg.ImportPiVPN(path, now)
+	default:
+		return newImportReport(source), fmt.Errorf("unknown import source: %s", source)
+	}
+}
@@ -0,0 +1,168 @@
+package wireguard_go_ubuntu
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Каталог установки PiVPN: wg0.conf, configs/<name>.conf и configs/clients.txt
+const piVPNDir = "/etc/wireguard"
+
+// Префикс строк отключённого клиента в wg0.conf PiVPN
+const piVPNDisabled = "#[disabled] "
+
+// Запись configs/clients.txt: "<name> <public key> <unix time>"
+type piVPNClient struct {
+	Name      string
+	CreatedAt time.Time
+}
+
+// Разбор clients.txt по публичным ключам
+func parsePiVPNClients(data string, report *ImportReport) map[string]piVPNClient {
+	clients := map[string]piVPNClient{}
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			report.skip("clients.txt "+fields[0], "line has no public key")
+			continue
+		}
+		client := piVPNClient{Name: fields[0]}
+		if len(fields) > 2 {
+			if sec, err := strconv.ParseInt(fields[2], 10, 64); err == nil {
+				client.CreatedAt = time.Unix(sec, 0).UTC()
+			}
+		}
+		clients[fields[1]] = client
+	}
+	return clients
+}
+
+// Импорт установки PiVPN в пустое состояние. Сервер и пиры берутся из
+// wg0.conf, как при импорте wg-quick, отключённые клиенты раскомментируются
+// и переносятся остановленными. Имена и даты создания — из clients.txt,
+// приватные ключи и конфигурации клиентов — из configs/<name>.conf.
+func (wg *WireGuardConfig) ImportPiVPN(dir string, now time.Time) (ImportReport, error) {
+	report := newImportReport(ImportPiVPN)
+	data, err := os.ReadFile(filepath.Join(dir, "wg0.conf"))
+	if err != nil {
+		return report, err
+	}
+	var lines []string
+	disabled := map[string]bool{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if rest, ok := strings.CutPrefix(line, piVPNDisabled); ok {
+			line = rest
+			if key, value, ok := strings.Cut(rest, "="); ok && strings.TrimSpace(key) == "PublicKey" {
+				disabled[strings.TrimSpace(value)] = true
+			}
+		}
+		lines = append(lines, line)
+	}
+	if err := wg.importWgQuick(strings.Join(lines, "\n"), now, &report); err != nil {
+		return report, err
+	}
+
+	listed := map[string]piVPNClient{}
+	if data, err := os.ReadFile(filepath.Join(dir, "configs", "clients.txt")); err == nil {
+		listed = parsePiVPNClients(string(data), &report)
+	} else {
+		report.warn("failed to read clients.txt: %v, names are taken from wg0.conf comments", err)
+	}
+
+	ids := make([]int, 0, len(wg.Clients))
+	for id := range wg.Clients {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	used := map[string]bool{}
+	kept := map[string]bool{}
+	for _, id := range ids {
+		client := wg.Clients[id]
+		client.Status = !disabled[client.PublicClientKey]
+		if entry, ok := listed[client.PublicClientKey]; ok {
+			used[client.PublicClientKey] = true
+			client.Name = entry.Name
+			if !entry.CreatedAt.IsZero() {
+				client.CreatedAt = entry.CreatedAt
+			}
+		} else {
+			report.warn("client %d (%s): not listed in clients.txt, creation date set to import time", id, client.Name)
+		}
+		if client.Name != "" {
+			for _, setting := range wg.importPiVPNConfig(filepath.Join(dir, "configs", client.Name+".conf"), &client, &report) {
+				kept[setting] = true
+			}
+		}
+		wg.Clients[id] = client
+	}
+
+	settings := make([]string, 0, len(kept))
+	for setting := range kept {
+		settings = append(settings, setting)
+	}
+	sort.Strings(settings)
+	for _, setting := range settings {
+		report.warn("client configs from PiVPN have %s, it is kept only in the conf download", setting)
+	}
+
+	names := make([]string, 0, len(listed))
+	for key, entry := range listed {
+		if !used[key] {
+			names = append(names, entry.Name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		report.skip("clients.txt "+name, "no peer in wg0.conf")
+	}
+	report.addClients(wg.Clients)
+	return report, nil
+}
+
+// Приватный ключ и конфигурация клиента из configs/<name>.conf. Файл
+// сохраняется как Config без изменений. Возвращает настройки PiVPN,
+// которых нет в остальных форматах выгрузки.
+func (wg *WireGuardConfig) importPiVPNConfig(path string, client *Client, report *ImportReport) []string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		report.skip(filepath.Base(path), "failed to read client config: %v", err)
+		return nil
+	}
+	iface, peers := parseWgQuick(string(data))
+	if iface == nil || iface.Values["PrivateKey"] == "" {
+		report.skip(filepath.Base(path), "no [Interface] section with PrivateKey")
+		return nil
+	}
+	privateKey := iface.Values["PrivateKey"]
+	if publicKey, err := publicKeyFor(privateKey); err == nil && publicKey != client.PublicClientKey {
+		report.skip(filepath.Base(path), "private key does not match peer %s", client.PublicClientKey)
+		return nil
+	}
+	client.PrivateClientKey = privateKey
+	client.Config = string(data)
+
+	var settings []string
+	if dns := iface.Values["DNS"]; dns != "" && dns != DefaultClientDNS {
+		settings = append(settings, "DNS "+dns)
+	}
+	if len(peers) > 0 {
+		if endpoint := peers[0].Values["Endpoint"]; endpoint != "" {
+			// Клиенты PiVPN подключаются по pivpnHOST, которого нет в wg0.conf
+			client.Peer.Endpoint = endpoint
+			wg.Endpoint = endpoint
+		}
+		if allowed := peers[0].Values["AllowedIPs"]; allowed != "" && !strings.Contains(allowed, "0.0.0.0/0") {
+			settings = append(settings, "AllowedIPs "+allowed)
+		}
+	}
+	return settings
+}
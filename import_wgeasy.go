@@ -0,0 +1,169 @@
+package wireguard_go_ubuntu
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Каталог данных wg-easy на хосте из примера docker-compose (~/.wg-easy)
+const wgEasyDir = "/root/.wg-easy"
+
+// Порт wg-easy по умолчанию (WG_PORT)
+const wgEasyPort = "51820"
+
+// wg0.json wg-easy до версии 15
+type wgEasyState struct {
+	Server struct {
+		PrivateKey string `json:"privateKey"`
+		PublicKey  string `json:"publicKey"`
+		Address    string `json:"address"` // адрес сервера без маски, сеть всегда /24
+	} `json:"server"`
+	Clients map[string]wgEasyClient `json:"clients"`
+}
+
+type wgEasyClient struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	Address      string `json:"address"`
+	PrivateKey   string `json:"privateKey"`
+	PublicKey    string `json:"publicKey"`
+	PreSharedKey string `json:"preSharedKey"`
+	CreatedAt    string `json:"createdAt"`
+	Enabled      *bool  `json:"enabled"` // нет в ранних версиях, клиент включён
+	ExpiredAt    string `json:"expiredAt"`
+	OneTimeLink  string `json:"oneTimeLink"`
+}
+
+// Импорт wg0.json wg-easy в пустое состояние. Ключи, в том числе общие,
+// переносятся, поэтому клиентам не нужны новые конфигурации, если сервер
+// останется по тому же адресу и порту. listenPort — порт из wg0.conf
+// рядом с wg0.json, пусто — порт wg-easy по умолчанию.
+func (wg *WireGuardConfig) ImportWgEasy(data []byte, listenPort string, now time.Time) (ImportReport, error) {
+	report := newImportReport(ImportWgEasy)
+	if err := wg.checkImportTarget(); err != nil {
+		return report, err
+	}
+	var state wgEasyState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return report, fmt.Errorf("invalid wg0.json: %v", err)
+	}
+	if state.Server.PrivateKey == "" {
+		return report, fmt.Errorf("wg0.json has no server privateKey")
+	}
+
+	wg.PrivateKey, wg.PublicKey = state.Server.PrivateKey, state.Server.PublicKey
+	if wg.PublicKey == "" {
+		if publicKey, err := publicKeyFor(wg.PrivateKey); err == nil {
+			wg.PublicKey = publicKey
+		} else {
+			report.warn("failed to derive server public key: %v", err)
+		}
+	}
+	var network *net.IPNet
+	if ip := net.ParseIP(state.Server.Address); ip != nil && ip.To4() != nil {
+		wg.Address = state.Server.Address + "/24"
+		_, network, _ = net.ParseCIDR(wg.Address)
+	} else {
+		report.warn("invalid server address %q, client ids are assigned in order", state.Server.Address)
+	}
+	wg.ListenPort = listenPort
+	if wg.ListenPort == "" {
+		wg.ListenPort = wgEasyPort
+		report.warn("no wg0.conf next to wg0.json, listen port set to the wg-easy default %s", wgEasyPort)
+	}
+	wg.detectEndpoint(&report)
+	report.warn("WG_HOST, WG_DEFAULT_DNS and WG_ALLOWED_IPS are not stored in wg0.json, client configs use endpoint %s, DNS %s and AllowedIPs 0.0.0.0/0", wg.Endpoint, DefaultClientDNS)
+
+	// Порядок клиентов: по дате создания, затем по id wg-easy
+	entries := make([]wgEasyClient, 0, len(state.Clients))
+	for key, entry := range state.Clients {
+		if entry.ID == "" {
+			entry.ID = key
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, k int) bool {
+		if entries[i].CreatedAt != entries[k].CreatedAt {
+			return entries[i].CreatedAt < entries[k].CreatedAt
+		}
+		return entries[i].ID < entries[k].ID
+	})
+
+	var clients []Client
+	seen := map[string]bool{}
+	for _, entry := range entries {
+		item := fmt.Sprintf("client %s (%s)", entry.ID, entry.Name)
+		switch {
+		case entry.PublicKey == "":
+			report.skip(item, "no publicKey")
+			continue
+		case seen[entry.PublicKey]:
+			report.skip(item, "duplicate publicKey %s", entry.PublicKey)
+			continue
+		case net.ParseIP(entry.Address) == nil:
+			report.skip(item, "invalid address %q", entry.Address)
+			continue
+		}
+		seen[entry.PublicKey] = true
+
+		client := Client{
+			Name:             entry.Name,
+			Status:           entry.Enabled == nil || *entry.Enabled,
+			AddressClient:    entry.Address + "/32",
+			PrivateClientKey: entry.PrivateKey,
+			PublicClientKey:  entry.PublicKey,
+			PresharedKey:     entry.PreSharedKey,
+			CreatedAt:        now,
+		}
+		if created, err := time.Parse(time.RFC3339, entry.CreatedAt); err == nil {
+			client.CreatedAt = created
+		} else {
+			report.warn("%s: invalid createdAt %q, creation date set to import time", item, entry.CreatedAt)
+		}
+		client.Peer.PublicKey = wg.PublicKey
+		client.PeerStr = canonicalPeer(client)
+		if client.PrivateClientKey != "" {
+			client.Config = wg.ClientConfig(client).WgQuick()
+		}
+		if entry.ExpiredAt != "" {
+			report.skip(item+" expiredAt", "expiry %s is not supported, the client stays enabled until stopped", entry.ExpiredAt)
+		}
+		if entry.OneTimeLink != "" {
+			report.skip(item+" oneTimeLink", "one-time links are not supported")
+		}
+		clients = append(clients, client)
+	}
+
+	wg.Clients = numberClients(network, clients, &report)
+	wg.Provisioned = ProvisionRecord{At: now}
+	report.addClients(wg.Clients)
+	report.warn("stop the wg-easy container before starting wg0 on this host")
+	return report, nil
+}
+
+// Чтение установки wg-easy: path — wg0.json или каталог с ним
+func (wg *WireGuardConfig) importWgEasyPath(path string, now time.Time) (ImportReport, error) {
+	if path == "" {
+		path = wgEasyDir
+	}
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		dir := path
+		path = filepath.Join(dir, "wg0.json")
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			if _, err := os.Stat(filepath.Join(dir, "wg-easy.db")); err == nil {
+				return newImportReport(ImportWgEasy), fmt.Errorf("%s: wg-easy 15 database is not supported, only wg0.json", dir)
+			}
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return newImportReport(ImportWgEasy), err
+	}
+	_, listenPort := readInterfaceSettings(filepath.Join(filepath.Dir(path), "wg0.conf"))
+	return wg.ImportWgEasy(data, listenPort, now)
+}
@@ -0,0 +1,141 @@
+package wireguard_go_ubuntu
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Действия политики простоя
+const (
+	InactivityActionFlag = "flag" // пометить клиента неактивным
+	InactivityActionStop = "stop" // остановить клиента
+)
+
+// Политика отключения клиентов без рукопожатий
+type InactivityPolicy struct {
+	Days    int    `json:"days"`    // срок простоя в днях, 0 — политика отключена
+	Action  string `json:"action"`  // flag или stop
+	Enforce bool   `json:"enforce"` // false — только отчёт (dry-run)
+}
+
+// Клиент, попавший под политику простоя
+type InactiveClient struct {
+	Id       int       `json:"id"`
+	Name     string    `json:"name"`
+	LastSeen time.Time `json:"last_seen"` // последнее рукопожатие или активация, без них — дата создания
+	IdleDays int       `json:"idle_days"`
+	Action   string    `json:"action"`          // выполненное действие, пусто в режиме dry-run и если остановка не удалась
+	Error    string    `json:"error,omitempty"` // ошибка остановки клиента
+}
+
+// Отчёт проверки простоя
+type InactivityReport struct {
+	CheckedAt time.Time        `json:"checked_at"`
+	DryRun    bool             `json:"dry_run"`
+	Days      int              `json:"days"`
+	Action    string           `json:"action"`
+	Clients   []InactiveClient `json:"clients"`
+}
+
+// Проверка корректности политики
+func (p InactivityPolicy) Validate() error {
+	if p.Days < 0 {
+		return fmt.Errorf("inactivity days must not be negative")
+	}
+	if p.Action != "" && p.Action != InactivityActionFlag && p.Action != InactivityActionStop {
+		return fmt.Errorf("unknown inactivity action: %s", p.Action)
+	}
+	return nil
+}
+
+// Проверка клиентов на простой. При dryRun или выключенном Enforce
+// состояние не меняется, возвращается только список кандидатов.
+func (wg *WireGuardConfig) CheckInactivity(now time.Time, dryRun bool) InactivityReport {
+	policy := wg.Inactivity
+	action := policy.Action
+	if action == "" {
+		action = InactivityActionFlag
+	}
+	dryRun = dryRun || !policy.Enforce
+
+	report := InactivityReport{CheckedAt: now, DryRun: dryRun, Days: policy.Days, Action: action}
+	if policy.Days <= 0 {
+		return report
+	}
+	limit := time.Duration(policy.Days) * 24 * time.Hour
+
+	ids := make([]int, 0, len(wg.Clients))
+	for id := range wg.Clients {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		client := wg.Clients[id]
+
+		// Клиент снова подключался после пометки — снимаем её
+		if !client.InactiveSince.IsZero() && client.LastSeen.After(client.InactiveSince) && !dryRun {
+			client.InactiveSince = time.Time{}
+			wg.Clients[id] = client
+		}
+		if !client.Status || !client.InactiveSince.IsZero() {
+			continue
+		}
+
+		lastSeen := client.LastSeen
+		if client.ActivatedAt.After(lastSeen) {
+			lastSeen = client.ActivatedAt
+		}
+		if lastSeen.IsZero() {
+			lastSeen = client.CreatedAt
+		}
+		// Для старых записей без рукопожатий и даты создания срок простоя неизвестен
+		if lastSeen.IsZero() || now.Sub(lastSeen) < limit {
+			continue
+		}
+
+		entry := InactiveClient{
+			Id:       id,
+			Name:     client.Name,
+			LastSeen: lastSeen,
+			IdleDays: int(now.Sub(lastSeen).Hours() / 24),
+		}
+		if !dryRun {
+			client.InactiveSince = now
+			wg.Clients[id] = client
+			entry.Action = action
+			if action == InactivityActionStop {
+				// Если остановить не удалось, пометка снимается, чтобы
+				// следующая проверка повторила остановку
+				if err := wg.StopClient(id); err != nil {
+					client.InactiveSince = time.Time{}
+					wg.Clients[id] = client
+					entry.Action = ""
+					entry.Error = err.Error()
+				}
+			}
+		}
+		report.Clients = append(report.Clients, entry)
+	}
+	return report
+}
+
+// Текст отчёта для уведомления администратора
+func (report InactivityReport) Text() string {
+	var b strings.Builder
+	if report.DryRun {
+		fmt.Fprintf(&b, "Проверка простоя (dry-run): %d клиентов без рукопожатий дольше %d дней\n", len(report.Clients), report.Days)
+	} else {
+		fmt.Fprintf(&b, "Проверка простоя: действие %s применено к %d клиентам без рукопожатий дольше %d дней\n", report.Action, len(report.Clients), report.Days)
+	}
+	for _, c := range report.Clients {
+		fmt.Fprintf(&b, "Клиент %d %s простой %d дней, последняя активность %s", c.Id, c.Name, c.IdleDays, c.LastSeen.Format("2006-01-02"))
+		if c.Error != "" {
+			fmt.Fprintf(&b, ", не остановлен: %s", c.Error)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,136 @@
+package wireguard_go_ubuntu
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Состояния шага журнала
+const (
+	StepDone       = "done"
+	StepFailed     = "failed"
+	StepSkipped    = "skipped"
+	StepUndone     = "undone"
+	StepUndoFailed = "undo_failed"
+)
+
+// Сколько последних журналов хранить в памяти
+const journalHistorySize = 50
+
+// Шаг применения изменений
+type JournalEntry struct {
+	Step   string `json:"step"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+
+	undo func() error // компенсирующее действие, nil — отменять нечего
+}
+
+// Журнал применения изменений на хосте: каждый выполненный шаг хранит
+// компенсирующее действие, при ошибке шаги отменяются в обратном порядке.
+type Journal struct {
+	Operation  string         `json:"operation"`
+	StartedAt  time.Time      `json:"started_at"`
+	FinishedAt time.Time      `json:"finished_at"`
+	Entries    []JournalEntry `json:"entries"`
+	RolledBack bool           `json:"rolled_back"`
+	Error      string         `json:"error,omitempty"`
+}
+
+func NewJournal(operation string) *Journal {
+	return &Journal{Operation: operation, StartedAt: time.Now()}
+}
+
+// Выполнение шага. do возвращает действие для отмены того, что он
+// действительно изменил, или nil, если менять ничего не пришлось.
+func (j *Journal) Do(step string, do func() (func() error, error)) error {
+	undo, err := do()
+	if err != nil {
+		j.Entries = append(j.Entries, JournalEntry{Step: step, Status: StepFailed, Error: err.Error()})
+		return fmt.Errorf("%s: %w", step, err)
+	}
+	j.Entries = append(j.Entries, JournalEntry{Step: step, Status: StepDone, undo: undo})
+	return nil
+}
+
+// Пропущенный шаг, например если на хосте нет ufw
+func (j *Journal) Skip(step, reason string) {
+	j.Entries = append(j.Entries, JournalEntry{Step: step, Status: StepSkipped, Error: reason})
+}
+
+// Отмена выполненных шагов в обратном порядке
+func (j *Journal) Rollback() {
+	j.RolledBack = true
+	for i := len(j.Entries) - 1; i >= 0; i-- {
+		entry := &j.Entries[i]
+		if entry.Status != StepDone || entry.undo == nil {
+			continue
+		}
+		if err := entry.undo(); err != nil {
+			entry.Status = StepUndoFailed
+			entry.Error = err.Error()
+			log.Printf("Ошибка отмены шага %q: %v", entry.Step, err)
+			continue
+		}
+		entry.Status = StepUndone
+	}
+}
+
+// Завершение журнала: при ошибке откат, затем запись в историю. Возвращает err.
+func (j *Journal) Finish(err error) error {
+	if err != nil {
+		j.Error = err.Error()
+		j.Rollback()
+		log.Printf("Ошибка операции %q, изменения отменены: %v", j.Operation, err)
+	}
+	j.FinishedAt = time.Now()
+	journals.add(*j)
+	return err
+}
+
+// Завершение без отката для операций с независимыми шагами, например удаления:
+// журнал служит отчётом о каждом шаге. Возвращает err.
+func (j *Journal) Report(err error) error {
+	if err != nil {
+		j.Error = err.Error()
+		log.Printf("Ошибка операции %q: %v", j.Operation, err)
+	}
+	j.FinishedAt = time.Now()
+	journals.add(*j)
+	return err
+}
+
+// История журналов применения
+type journalHistory struct {
+	mu    sync.Mutex
+	items []Journal
+}
+
+var journals = &journalHistory{}
+
+func (h *journalHistory) add(j Journal) {
+	// Действия отмены больше не нужны, не держим их замыкания
+	j.Entries = append([]JournalEntry(nil), j.Entries...)
+	for i := range j.Entries {
+		j.Entries[i].undo = nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.items = append(h.items, j)
+	if len(h.items) > journalHistorySize {
+		h.items = h.items[len(h.items)-journalHistorySize:]
+	}
+}
+
+// Последние журналы применения, новые первыми
+func RecentJournals() []Journal {
+	journals.mu.Lock()
+	defer journals.mu.Unlock()
+	result := make([]Journal, 0, len(journals.items))
+	for i := len(journals.items) - 1; i >= 0; i-- {
+		result = append(result, journals.items[i])
+	}
+	return result
+}
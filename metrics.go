@@ -0,0 +1,284 @@
+package wireguard_go_ubuntu
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Границы гистограммы длительности запросов API, в секундах
+var requestDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Гистограмма длительностей
+type histogram struct {
+	counts []uint64 // по одному счётчику на границу из requestDurationBuckets
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range requestDurationBuckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// Счётчик операций с суммарной длительностью
+type durationCounter struct {
+	count uint64
+	sum   float64
+}
+
+type requestKey struct {
+	route  string
+	method string
+}
+
+type requestCodeKey struct {
+	route  string
+	method string
+	code   int
+}
+
+// Метрики сервиса в формате Prometheus
+type Metrics struct {
+	mu        sync.Mutex
+	durations map[requestKey]*histogram
+	requests  map[requestCodeKey]uint64
+	applies   durationCounter
+	restarts  map[string]*durationCounter // по результату: success / failure
+}
+
+// Метрики процесса
+var metrics = NewMetrics()
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		durations: make(map[requestKey]*histogram),
+		requests:  make(map[requestCodeKey]uint64),
+		restarts:  make(map[string]*durationCounter),
+	}
+}
+
+// Учёт запроса к API
+func (m *Metrics) ObserveRequest(route, method string, code int, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := requestKey{route: route, method: method}
+	h, ok := m.durations[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(requestDurationBuckets))}
+		m.durations[key] = h
+	}
+	h.observe(d.Seconds())
+	m.requests[requestCodeKey{route: route, method: method, code: code}]++
+}
+
+// Учёт применения конфигурации wg0.conf, вызывается через defer с моментом начала
+func (m *Metrics) ObserveApply(start time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.applies.count++
+	m.applies.sum += time.Since(start).Seconds()
+}
+
+// Учёт перезапуска сервиса WireGuard
+func (m *Metrics) ObserveRestart(start time.Time, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	c, ok := m.restarts[result]
+	if !ok {
+		c = &durationCounter{}
+		m.restarts[result] = c
+	}
+	c.count++
+	c.sum += time.Since(start).Seconds()
+}
+
+// Обёртка обработчика API для учёта длительности и ошибок
+func (m *Metrics) Instrument(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+		m.ObserveRequest(route, r.Method, rec.status, time.Since(start))
+	}
+}
+
+// Запоминает код ответа обработчика
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Вывод метрик API и операций с конфигурацией
+func (m *Metrics) Write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeHeader(w, "wgmanager_http_requests_total", "counter", "API requests by route, method and status code.")
+	codeKeys := make([]requestCodeKey, 0, len(m.requests))
+	for key := range m.requests {
+		codeKeys = append(codeKeys, key)
+	}
+	sort.Slice(codeKeys, func(i, j int) bool {
+		a, b := codeKeys[i], codeKeys[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.code < b.code
+	})
+	for _, key := range codeKeys {
+		fmt.Fprintf(w, "wgmanager_http_requests_total{%s} %d\n",
+			labels("route", key.route, "method", key.method, "code", strconv.Itoa(key.code)), m.requests[key])
+	}
+
+	writeHeader(w, "wgmanager_http_request_errors_total", "counter", "API requests that ended with status code 400 or higher.")
+	for _, key := range codeKeys {
+		if key.code >= http.StatusBadRequest {
+			fmt.Fprintf(w, "wgmanager_http_request_errors_total{%s} %d\n",
+				labels("route", key.route, "method", key.method, "code", strconv.Itoa(key.code)), m.requests[key])
+		}
+	}
+
+	writeHeader(w, "wgmanager_http_request_duration_seconds", "histogram", "API request latency.")
+	keys := make([]requestKey, 0, len(m.durations))
+	for key := range m.durations {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		return keys[i].method < keys[j].method
+	})
+	for _, key := range keys {
+		h := m.durations[key]
+		for i, bound := range requestDurationBuckets {
+			fmt.Fprintf(w, "wgmanager_http_request_duration_seconds_bucket{%s} %d\n",
+				labels("route", key.route, "method", key.method, "le", formatFloat(bound)), h.counts[i])
+		}
+		fmt.Fprintf(w, "wgmanager_http_request_duration_seconds_bucket{%s} %d\n",
+			labels("route", key.route, "method", key.method, "le", "+Inf"), h.count)
+		fmt.Fprintf(w, "wgmanager_http_request_duration_seconds_sum{%s} %s\n",
+			labels("route", key.route, "method", key.method), formatFloat(h.sum))
+		fmt.Fprintf(w, "wgmanager_http_request_duration_seconds_count{%s} %d\n",
+			labels("route", key.route, "method", key.method), h.count)
+	}
+
+	writeHeader(w, "wgmanager_config_applies_total", "counter", "Writes of wg0.conf including the service restart.")
+	fmt.Fprintf(w, "wgmanager_config_applies_total %d\n", m.applies.count)
+	writeHeader(w, "wgmanager_config_apply_duration_seconds_total", "counter", "Total time spent applying wg0.conf.")
+	fmt.Fprintf(w, "wgmanager_config_apply_duration_seconds_total %s\n", formatFloat(m.applies.sum))
+
+	writeHeader(w, "wgmanager_service_restarts_total", "counter", "Restarts of wg-quick@wg0 by result.")
+	for _, result := range []string{"success", "failure"} {
+		var c durationCounter
+		if rc, ok := m.restarts[result]; ok {
+			c = *rc
+		}
+		fmt.Fprintf(w, "wgmanager_service_restarts_total{%s} %d\n", labels("result", result), c.count)
+	}
+	writeHeader(w, "wgmanager_service_restart_duration_seconds_total", "counter", "Total time spent restarting wg-quick@wg0.")
+	for _, result := range []string{"success", "failure"} {
+		var c durationCounter
+		if rc, ok := m.restarts[result]; ok {
+			c = *rc
+		}
+		fmt.Fprintf(w, "wgmanager_service_restart_duration_seconds_total{%s} %s\n", labels("result", result), formatFloat(c.sum))
+	}
+}
+
+// Вывод метрик пиров и клиентов по данным CollectPeerStats
+func WritePeerMetrics(w io.Writer, clients map[int]Client, stats map[string]PeerStats, now time.Time) {
+	var active, stopped int
+	for _, client := range clients {
+		if client.Status {
+			active++
+		} else {
+			stopped++
+		}
+	}
+	writeHeader(w, "wgmanager_clients", "gauge", "Clients by status.")
+	fmt.Fprintf(w, "wgmanager_clients{%s} %d\n", labels("status", "active"), active)
+	fmt.Fprintf(w, "wgmanager_clients{%s} %d\n", labels("status", "stopped"), stopped)
+
+	byKey := make(map[string]Client, len(clients))
+	for _, client := range clients {
+		byKey[client.PublicClientKey] = client
+	}
+	peerKeys := make([]string, 0, len(stats))
+	for key := range stats {
+		peerKeys = append(peerKeys, key)
+	}
+	sort.Strings(peerKeys)
+
+	peerLabels := func(key string) string {
+		client, ok := byKey[key]
+		id := ""
+		if ok {
+			id = strconv.Itoa(client.Id)
+		}
+		return labels("client_id", id, "name", client.Name, "public_key", key)
+	}
+
+	writeHeader(w, "wgmanager_peer_receive_bytes_total", "counter", "Bytes received from the peer.")
+	for _, key := range peerKeys {
+		fmt.Fprintf(w, "wgmanager_peer_receive_bytes_total{%s} %d\n", peerLabels(key), stats[key].TransferRx)
+	}
+	writeHeader(w, "wgmanager_peer_transmit_bytes_total", "counter", "Bytes sent to the peer.")
+	for _, key := range peerKeys {
+		fmt.Fprintf(w, "wgmanager_peer_transmit_bytes_total{%s} %d\n", peerLabels(key), stats[key].TransferTx)
+	}
+	writeHeader(w, "wgmanager_peer_last_handshake_age_seconds", "gauge", "Seconds since the latest handshake; peers without a handshake are omitted.")
+	for _, key := range peerKeys {
+		if hs := stats[key].LatestHandshake; !hs.IsZero() {
+			fmt.Fprintf(w, "wgmanager_peer_last_handshake_age_seconds{%s} %s\n", peerLabels(key), formatFloat(now.Sub(hs).Seconds()))
+		}
+	}
+}
+
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// Сборка меток из пар имя-значение
+func labels(pairs ...string) string {
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, pairs[i], escapeLabel(pairs[i+1])))
+	}
+	return strings.Join(parts, ",")
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,351 @@
+package wireguard_go_ubuntu
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/telebot.v3"
+)
+
+// События уведомлений
+const (
+	EventConfigDelivery = "config_delivery" // выдача конфигурации клиенту
+	EventAdmin          = "admin"           // события для администраторов
+)
+
+// Каналы доставки
+const (
+	ChannelTelegram = "telegram"
+	ChannelEmail    = "email"
+	ChannelWebhook  = "webhook"
+)
+
+// Уведомление
+type Notification struct {
+	Event       string       `json:"event"`
+	ClientID    int          `json:"client_id,omitempty"`
+	Subject     string       `json:"subject"`
+	Text        string       `json:"text"`
+	Attachments []ConfigFile `json:"-"`
+}
+
+// Адресат уведомления
+type Contact struct {
+	TgId       int    `json:"tg_id,omitempty"`
+	Email      string `json:"email,omitempty"`
+	WebhookURL string `json:"webhook_url,omitempty"`
+}
+
+// Способ доставки уведомлений
+type Notifier interface {
+	// Канал доставки: telegram, email или webhook
+	Channel() string
+	// Может ли канал доставить уведомление адресату
+	CanNotify(to Contact) bool
+	Notify(to Contact, n Notification) error
+}
+
+// Настройки уведомлений
+type NotifyConfig struct {
+	SMTPHost     string   `json:"smtp_host"`
+	SMTPPort     int      `json:"smtp_port"`
+	SMTPUsername string   `json:"smtp_username"`
+	SMTPPassword string   `json:"-"` // только из настроек демона, в файл состояния не пишется
+	SMTPFrom     string   `json:"smtp_from"`
+	WebhookURL   string   `json:"webhook_url"`  // webhook для событий администраторов
+	AdminEmails  []string `json:"admin_emails"` // почта администраторов для событий admin
+}
+
+// ------------------------ Telegram ------------------------
+type TelegramNotifier struct {
+	Token string
+}
+
+func (t TelegramNotifier) Channel() string { return ChannelTelegram }
+
+func (t TelegramNotifier) CanNotify(to Contact) bool { return t.Token != "" && to.TgId != 0 }
+
+func (t TelegramNotifier) Notify(to Contact, n Notification) error {
+	bot, err := telegramBot(t.Token)
+	if err != nil {
+		return err
+	}
+	chat := telebot.ChatID(int64(to.TgId))
+	if _, err := bot.Send(chat, n.Text); err != nil {
+		return fmt.Errorf("failed to send telegram message: %v", err)
+	}
+	for _, f := range n.Attachments {
+		doc := &telebot.Document{File: telebot.FromReader(bytes.NewReader(f.Data)), FileName: f.Name}
+		if _, err := bot.Send(chat, doc); err != nil {
+			return fmt.Errorf("failed to send telegram document: %v", err)
+		}
+	}
+	return nil
+}
+
+// ------------------------ SMTP ------------------------
+type SMTPNotifier struct {
+	Host     string
+	Port     int
+	Username string // пусто — без авторизации (например, локальный релей)
+	Password string
+	From     string
+}
+
+func (s SMTPNotifier) Channel() string { return ChannelEmail }
+
+func (s SMTPNotifier) CanNotify(to Contact) bool { return s.Host != "" && to.Email != "" }
+
+func (s SMTPNotifier) Notify(to Contact, n Notification) error {
+	msg, err := buildMail(s.From, to.Email, n)
+	if err != nil {
+		return err
+	}
+
+	port := s.Port
+	if port == 0 {
+		port = 25
+	}
+	addr := net.JoinHostPort(s.Host, strconv.Itoa(port))
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, s.Host)
+	}
+	if err := smtp.SendMail(addr, auth, s.From, []string{to.Email}, msg); err != nil {
+		return fmt.Errorf("failed to send email: %v", err)
+	}
+	return nil
+}
+
+// Письмо MIME: текст и вложения
+func buildMail(from, to string, n Notification) ([]byte, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	text, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := writeBase64(text, []byte(n.Text)); err != nil {
+		return nil, err
+	}
+
+	for _, f := range n.Attachments {
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {"application/octet-stream"},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": f.Name})},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeBase64(part, f.Data); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.BEncoding.Encode("utf-8", n.Subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", mw.Boundary())
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+// Base64 со строками по 76 символов
+func writeBase64(w io.Writer, data []byte) error {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		if _, err := w.Write([]byte(encoded[:76] + "\r\n")); err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+	_, err := w.Write([]byte(encoded + "\r\n"))
+	return err
+}
+
+// ------------------------ Webhook ------------------------
+type WebhookNotifier struct {
+	Client *http.Client
+}
+
+func (wh WebhookNotifier) Channel() string { return ChannelWebhook }
+
+func (wh WebhookNotifier) CanNotify(to Contact) bool { return to.WebhookURL != "" }
+
+// Тело запроса webhook
+type webhookPayload struct {
+	Notification
+	Attachments []webhookAttachment `json:"attachments,omitempty"`
+}
+
+type webhookAttachment struct {
+	Name string `json:"name"`
+	Data []byte `json:"data"` // base64 в JSON
+}
+
+func (wh WebhookNotifier) Notify(to Contact, n Notification) error {
+	payload := webhookPayload{Notification: n}
+	for _, f := range n.Attachments {
+		payload.Attachments = append(payload.Attachments, webhookAttachment{Name: f.Name, Data: f.Data})
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	client := wh.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Post(to.WebhookURL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to call webhook: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// ------------------------ рассылка ------------------------
+// Набор каналов доставки, собранный из настроек сервера
+type Notifiers []Notifier
+
+// Каналы доставки по настройкам сервера
+func (wg *WireGuardConfig) Notifiers() Notifiers {
+	var n Notifiers
+	if wg.BotToken != "" {
+		n = append(n, TelegramNotifier{Token: wg.BotToken})
+	}
+	if wg.Notify.SMTPHost != "" {
+		n = append(n, SMTPNotifier{
+			Host:     wg.Notify.SMTPHost,
+			Port:     wg.Notify.SMTPPort,
+			Username: wg.Notify.SMTPUsername,
+			Password: wg.Notify.SMTPPassword,
+			From:     wg.Notify.SMTPFrom,
+		})
+	}
+	n = append(n, WebhookNotifier{})
+	return n
+}
+
+// Контакт клиента для уведомлений
+func (client Client) Contact() Contact {
+	return Contact{TgId: client.TgId, Email: client.Email, WebhookURL: client.WebhookURL}
+}
+
+// Доставка уведомления клиенту по его предпочтениям. Если каналы не заданы,
+// используются все доступные. Возвращает ошибку, если ни один канал не сработал.
+func (ns Notifiers) NotifyClient(client Client, n Notification) error {
+	n.ClientID = client.Id
+	to := client.Contact()
+
+	var errs []string
+	delivered := false
+	for _, notifier := range ns {
+		if !client.wantsChannel(notifier.Channel()) || !notifier.CanNotify(to) {
+			continue
+		}
+		if err := notifier.Notify(to, n); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", notifier.Channel(), err))
+			continue
+		}
+		delivered = true
+	}
+	if delivered {
+		return nil
+	}
+	if len(errs) == 0 {
+		return fmt.Errorf("no notification channel available for client %d", client.Id)
+	}
+	return fmt.Errorf("notification failed: %s", strings.Join(errs, "; "))
+}
+
+// Предпочитает ли клиент канал
+func (client Client) wantsChannel(channel string) bool {
+	if len(client.NotifyChannels) == 0 {
+		return true
+	}
+	for _, c := range client.NotifyChannels {
+		if c == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// Доставка уведомления администраторам во все доступные каналы
+func (wg *WireGuardConfig) NotifyAdmins(n Notification) error {
+	if n.Event == "" {
+		n.Event = EventAdmin
+	}
+	var contacts []Contact
+	for _, id := range wg.AdminTgIds {
+		contacts = append(contacts, Contact{TgId: id})
+	}
+	for _, email := range wg.Notify.AdminEmails {
+		contacts = append(contacts, Contact{Email: email})
+	}
+	if wg.Notify.WebhookURL != "" {
+		contacts = append(contacts, Contact{WebhookURL: wg.Notify.WebhookURL})
+	}
+
+	var errs []string
+	notifiers := wg.Notifiers()
+	for _, to := range contacts {
+		for _, notifier := range notifiers {
+			if !notifier.CanNotify(to) {
+				continue
+			}
+			if err := notifier.Notify(to, n); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", notifier.Channel(), err))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("admin notification failed: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Уведомление с конфигурацией клиента: файл wg-quick и QR-код
+func ConfigNotification(client Client) (Notification, error) {
+	png, err := ConfigQRPNG(client, DefaultQRSize)
+	if err != nil {
+		return Notification{}, err
+	}
+	return Notification{
+		Event:   EventConfigDelivery,
+		Subject: "Конфигурация WireGuard",
+		Text:    fmt.Sprintf("Конфигурация WireGuard для клиента %d. Импортируйте файл или отсканируйте QR-код в приложении WireGuard.", client.Id),
+		Attachments: []ConfigFile{
+			{ConfigFileName(client), []byte(client.Config)},
+			{"qr.png", png},
+		},
+	}, nil
+}
@@ -0,0 +1,281 @@
+package wireguard_go_ubuntu
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Заглушка ключей, которые генерируются только при выполнении
+const plannedKey = "<generated>"
+
+// План изменения: что операция сделает на хосте, без самих изменений
+type Plan struct {
+	Operation string     `json:"operation"`
+	Diffs     []PlanDiff `json:"diffs"`           // пусто — файлы, правила и параметры не меняются
+	Commands  []string   `json:"commands"`        // команды в порядке выполнения
+	Notes     []string   `json:"notes,omitempty"` // чем выполнение может отличаться от плана
+}
+
+// Изменение файла, правил межсетевого экрана, параметров ядра или состояния
+type PlanDiff struct {
+	Name string `json:"name"`
+	Diff string `json:"diff"` // unified diff
+}
+
+func newPlan(operation string) Plan {
+	return Plan{Operation: operation, Diffs: []PlanDiff{}, Commands: []string{}}
+}
+
+func (p *Plan) diff(name string, before, after []byte) {
+	if diff := UnifiedDiff(name, before, after); diff != "" {
+		p.Diffs = append(p.Diffs, PlanDiff{Name: name, Diff: diff})
+	}
+}
+
+func (p *Plan) command(name string, args ...string) {
+	p.Commands = append(p.Commands, strings.TrimSpace(name+" "+strings.Join(args, " ")))
+}
+
+// Состояние хоста, от которого зависят шаги применения. Только чтение.
+type hostState struct {
+	config    []byte // wg0.conf, nil — файла нет
+	sysctl    []byte
+	ipForward string
+	ufw       bool // ufw установлен
+	ufwStatus string
+	enabled   bool
+	active    bool
+}
+
+func readHost() hostState {
+	host := hostState{
+		enabled: exec.Command("systemctl", "is-enabled", "--quiet", "wg-quick@wg0.service").Run() == nil,
+		active:  wireguardActive(),
+	}
+	host.config, _ = os.ReadFile(wgConfigFile)
+	host.sysctl, _ = os.ReadFile(sysctlFile)
+	if value, err := os.ReadFile(ipForwardProc); err == nil {
+		host.ipForward = strings.TrimSpace(string(value))
+	}
+	if _, err := exec.LookPath("ufw"); err == nil {
+		host.ufw = true
+		out, _ := exec.Command("ufw", "status").Output()
+		host.ufwStatus = string(out)
+	}
+	return host
+}
+
+// Копия конфигурации, изменения которой не затрагивают исходные клиенты
+func (wg *WireGuardConfig) clone() WireGuardConfig {
+	next := *wg
+	next.Clients = make(map[int]Client, len(wg.Clients))
+	for id, client := range wg.Clients {
+		next.Clients[id] = client
+	}
+	return next
+}
+
+// План записи wg0.conf: содержимое, которое будет записано, и изменится ли
+// файл. Приватный ключ сервера в diff скрыт.
+func (p *Plan) config(host hostState, current, next *WireGuardConfig) ([]byte, bool, error) {
+	content, err := next.ServerConfig()
+	if err != nil {
+		return nil, false, err
+	}
+	if bytes.Equal(host.config, []byte(content)) {
+		return []byte(content), false, nil
+	}
+	keys := []string{current.PrivateKey, next.PrivateKey}
+	p.diff(wgConfigFile, maskPrivateKeys(host.config, keys...), maskPrivateKeys([]byte(content), keys...))
+	return []byte(content), true, nil
+}
+
+// План провижининга: то же, что сделает Autostart
+func (wg *WireGuardConfig) PlanAutostart() (Plan, error) {
+	p := newPlan("provision")
+	host := readHost()
+	next := wg.clone()
+	next.adoptExistingInstall()
+	if next.ListenPort == "" {
+		next.RandomPort()
+		p.Notes = append(p.Notes, "listen port is chosen at random when applied")
+	}
+	if next.InterName == "" || next.Endpoint == "" {
+		if err := next.GetIPAndInterfaceName(); err != nil {
+			return Plan{}, err
+		}
+	}
+	if next.PrivateKey == "" {
+		p.command("wg", "genkey")
+		p.command("wg", "pubkey")
+		next.PrivateKey, next.PublicKey = plannedKey, plannedKey
+		p.diff(serverPrivateKeyFile, nil, []byte(plannedKey+"\n"))
+		p.diff(serverPublicKeyFile, nil, []byte(plannedKey+"\n"))
+		p.Notes = append(p.Notes, "server keys are generated when applied")
+	}
+
+	content, changed, err := p.config(host, wg, &next)
+	if err != nil {
+		return Plan{}, err
+	}
+	p.start(host, &next, content, changed)
+	return p, nil
+}
+
+// План шагов запуска, см. startSteps. config — wg0.conf, который будет записан.
+func (p *Plan) start(host hostState, next *WireGuardConfig, config []byte, configChanged bool) {
+	if sysctl, added := withLine(host.sysctl, ipForwardLine); added {
+		p.diff(sysctlFile, host.sysctl, sysctl)
+	}
+	if host.ipForward != "1" {
+		p.diff("sysctl", []byte("net.ipv4.ip_forward = "+host.ipForward+"\n"), []byte("net.ipv4.ip_forward = 1\n"))
+		p.command("sysctl", "-w", "net.ipv4.ip_forward=1")
+	}
+
+	// Правила ufw и PostUp работающего интерфейса до и после
+	prt := fmt.Sprintf("%s/udp", next.ListenPort)
+	var before, after []string
+	if host.ufw {
+		if strings.Contains(host.ufwStatus, prt) {
+			before = append(before, "ufw allow "+prt)
+		}
+		after = append(after, "ufw allow "+prt)
+		p.command("ufw", "allow", prt)
+	}
+	if host.active {
+		before = append(before, postUpRules(host.config)...)
+	}
+	after = append(after, postUpRules(config)...)
+	p.diff("firewall", joinLines(before), joinLines(after))
+
+	if !host.enabled {
+		p.command("systemctl", "enable", "wg-quick@wg0.service")
+	}
+	if !host.active {
+		p.command("systemctl", "start", "wg-quick@wg0.service")
+	} else if configChanged {
+		p.command("systemctl", "restart", "wg-quick@wg0")
+	}
+}
+
+// Команды PostUp из секции [Interface] wg0.conf: шаблонной или
+// импортированной. %i wg-quick заменяет на имя интерфейса.
+func postUpRules(config []byte) []string {
+	iface, _ := parseWgQuick(string(config))
+	if iface == nil {
+		return nil
+	}
+	var rules []string
+	for _, line := range iface.Lines {
+		key, value, _ := strings.Cut(line, "=")
+		if !strings.EqualFold(strings.TrimSpace(key), "PostUp") {
+			continue
+		}
+		for _, rule := range strings.Split(value, ";") {
+			if rule = strings.TrimSpace(rule); rule != "" {
+				rules = append(rules, strings.ReplaceAll(rule, "%i", "wg0"))
+			}
+		}
+	}
+	return rules
+}
+
+func joinLines(lines []string) []byte {
+	if len(lines) == 0 {
+		return []byte{}
+	}
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+// План изменения клиентов: то же, что сделает applyConfig после change
+func (wg *WireGuardConfig) planApply(operation string, change func(next *WireGuardConfig) error) (Plan, error) {
+	p := newPlan(operation)
+	next := wg.clone()
+	if err := change(&next); err != nil {
+		return Plan{}, err
+	}
+	host := readHost()
+	content, changed, err := p.config(host, wg, &next)
+	if err != nil {
+		return Plan{}, err
+	}
+	switch {
+	case !changed:
+	case !host.active:
+		p.Notes = append(p.Notes, "wg-quick@wg0 is not running, wg0.conf is applied on its next start")
+	case interfaceSection(string(host.config)) != interfaceSection(string(content)):
+		p.command("systemctl", "restart", "wg-quick@wg0")
+	default:
+		p.command("wg-quick", "strip", "wg0")
+		p.command("wg", "syncconf", "wg0", "<stripped wg0.conf>")
+	}
+	return p, nil
+}
+
+// План AddWireguardClient
+func (wg *WireGuardConfig) PlanAddClient(id int) (Plan, error) {
+	plan, err := wg.planApply(fmt.Sprintf("add client %d", id), func(next *WireGuardConfig) error {
+		next.Clients[id] = next.clientWithKeys(id, plannedKey, plannedKey)
+		return nil
+	})
+	if err != nil {
+		return Plan{}, err
+	}
+	plan.Commands = append([]string{"wg genkey", "wg pubkey"}, plan.Commands...)
+	plan.Notes = append(plan.Notes, "client keys are generated when applied")
+	return plan, nil
+}
+
+// План изменения статуса клиента: StopClient или ActClient
+func (wg *WireGuardConfig) PlanClientStatus(id int, active bool) (Plan, error) {
+	operation := fmt.Sprintf("stop client %d", id)
+	if active {
+		operation = fmt.Sprintf("activate client %d", id)
+	}
+	return wg.planApply(operation, func(next *WireGuardConfig) error {
+		client, exists := next.Clients[id]
+		if !exists {
+			return clientNotFound(id)
+		}
+		if client.Status && active {
+			return fmt.Errorf("%w: %d", ErrAlreadyActive, id)
+		}
+		if !client.Status && !active {
+			return fmt.Errorf("%w: %d", ErrAlreadyStopped, id)
+		}
+		client.Status = active
+		next.Clients[id] = client
+		return nil
+	})
+}
+
+// План DeleteClient
+func (wg *WireGuardConfig) PlanDeleteClient(id int) (Plan, error) {
+	return wg.planApply(fmt.Sprintf("delete client %d", id), func(next *WireGuardConfig) error {
+		if _, exists := next.Clients[id]; !exists {
+			return clientNotFound(id)
+		}
+		delete(next.Clients, id)
+		return nil
+	})
+}
+
+// План изменения настроек, которые хранятся только в состоянии:
+// diff их JSON, команд на хосте нет
+func PlanSettings(operation, name string, before, after interface{}) (Plan, error) {
+	p := newPlan(operation)
+	from, err := json.MarshalIndent(before, "", "  ")
+	if err != nil {
+		return Plan{}, err
+	}
+	to, err := json.MarshalIndent(after, "", "  ")
+	if err != nil {
+		return Plan{}, err
+	}
+	p.diff(name, append(from, '\n'), append(to, '\n'))
+	return p, nil
+}
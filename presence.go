@@ -0,0 +1,84 @@
+package wireguard_go_ubuntu
+
+import (
+	"time"
+)
+
+// Состояние подключения клиента по данным рукопожатий
+const (
+	PresenceOnline         = "online"
+	PresenceIdle           = "idle"
+	PresenceNeverConnected = "never-connected"
+)
+
+// Клиент считается в сети, если рукопожатие было не раньше этого срока.
+// WireGuard повторяет рукопожатие каждые 2 минуты при активной сессии.
+const OnlineThreshold = 3 * time.Minute
+
+// Сведения о клиенте для ответов API (без приватного ключа и конфигурации)
+type ClientInfo struct {
+	Id              int       `json:"id"`
+	Name            string    `json:"name"`
+	Status          bool      `json:"status"`
+	AddressClient   string    `json:"address_client"`
+	PublicKey       string    `json:"public_key"`
+	Presence        string    `json:"presence"`
+	LatestHandshake time.Time `json:"latest_handshake"`
+	Endpoint        string    `json:"endpoint"`
+	FirstSeen       time.Time `json:"first_seen"`
+	LastSeen        time.Time `json:"last_seen"`
+}
+
+// Состояние подключения клиента на момент now
+func (client Client) Presence(now time.Time) string {
+	if client.LatestHandshake.IsZero() {
+		return PresenceNeverConnected
+	}
+	if now.Sub(client.LatestHandshake) <= OnlineThreshold {
+		return PresenceOnline
+	}
+	return PresenceIdle
+}
+
+// Сведения о клиенте для API
+func (client Client) Info(now time.Time) ClientInfo {
+	return ClientInfo{
+		Id:              client.Id,
+		Name:            client.Name,
+		Status:          client.Status,
+		AddressClient:   client.AddressClient,
+		PublicKey:       client.PublicClientKey,
+		Presence:        client.Presence(now),
+		LatestHandshake: client.LatestHandshake,
+		Endpoint:        client.CurrentEndpoint,
+		FirstSeen:       client.FirstSeen,
+		LastSeen:        client.LastSeen,
+	}
+}
+
+// Обновление рукопожатий и адресов клиентов по данным CollectPeerStats.
+// Возвращает true, если изменились first-seen/last-seen и состояние стоит сохранить.
+func (wg *WireGuardConfig) UpdatePresence(stats map[string]PeerStats) bool {
+	changed := false
+	for id, client := range wg.Clients {
+		peer, ok := stats[client.PublicClientKey]
+		if !ok {
+			continue
+		}
+
+		client.CurrentEndpoint = peer.Endpoint
+		if !peer.LatestHandshake.IsZero() {
+			client.LatestHandshake = peer.LatestHandshake
+			if client.FirstSeen.IsZero() {
+				client.FirstSeen = peer.LatestHandshake
+				changed = true
+			}
+			if peer.LatestHandshake.After(client.LastSeen) {
+				client.LastSeen = peer.LatestHandshake
+				changed = true
+			}
+		}
+		wg.Clients[id] = client
+	}
+	return changed
+}
@@ -0,0 +1,85 @@
+package wireguard_go_ubuntu
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// Размер PNG с QR-кодом по умолчанию, в пикселях
+const DefaultQRSize = 512
+
+// QR-код конфигурации клиента для импорта в мобильные приложения WireGuard
+func clientQR(client Client) (*qrcode.QRCode, error) {
+	if client.Config == "" {
+		return nil, fmt.Errorf("client %d has no config", client.Id)
+	}
+	// Средний уровень коррекции: конфигурация занимает около 300 байт
+	q, err := qrcode.New(client.Config, qrcode.Medium)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode QR code: %v", err)
+	}
+	return q, nil
+}
+
+// QR-код конфигурации в формате PNG (для бота и API)
+func ConfigQRPNG(client Client, size int) ([]byte, error) {
+	q, err := clientQR(client)
+	if err != nil {
+		return nil, err
+	}
+	if size <= 0 {
+		size = DefaultQRSize
+	}
+	return q.PNG(size)
+}
+
+// QR-код конфигурации в формате SVG: по прямоугольнику на тёмный модуль
+func ConfigQRSVG(client Client) ([]byte, error) {
+	q, err := clientQR(client)
+	if err != nil {
+		return nil, err
+	}
+	bits := q.Bitmap()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, len(bits), len(bits))
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#fff"/>`, len(bits), len(bits))
+	for y, row := range bits {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&b, `<rect x="%d" y="%d" width="1" height="1"/>`, x, y)
+			}
+		}
+	}
+	b.WriteString("</svg>\n")
+	return []byte(b.String()), nil
+}
+
+// QR-код конфигурации для вывода в терминал (для CLI).
+// По умолчанию используются полублоки Unicode: одна строка текста на два ряда модулей;
+// ascii выводит светлые модули символами "##" для терминалов без Unicode.
+// Рассчитано на тёмный фон терминала.
+func ConfigQRTerminal(client Client, ascii bool) (string, error) {
+	q, err := clientQR(client)
+	if err != nil {
+		return "", err
+	}
+	if !ascii {
+		return q.ToSmallString(false), nil
+	}
+
+	var b strings.Builder
+	for _, row := range q.Bitmap() {
+		for _, dark := range row {
+			if dark {
+				b.WriteString("  ")
+			} else {
+				b.WriteString("##")
+			}
+		}
+		b.WriteString("\n")
+	}
+	return b.String(), nil
+}
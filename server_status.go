@@ -0,0 +1,36 @@
+package wireguard_go_ubuntu
+
+import "time"
+
+// Состояние сервера для CLI и API
+type ServerStatus struct {
+	Interface  string `json:"interface"`
+	Endpoint   string `json:"endpoint"`
+	ListenPort string `json:"listen_port"`
+	PublicKey  string `json:"public_key"`
+	Up         bool   `json:"up"` // интерфейс wg0 поднят и отвечает на wg show
+	Clients    int    `json:"clients"`
+	Active     int    `json:"active"`
+	Online     int    `json:"online"`
+}
+
+// Состояние сервера на момент now; up — результат опроса устройства
+func (wg *WireGuardConfig) Status(now time.Time, up bool) ServerStatus {
+	status := ServerStatus{
+		Interface:  wg.InterName,
+		Endpoint:   wg.Endpoint,
+		ListenPort: wg.ListenPort,
+		PublicKey:  wg.PublicKey,
+		Up:         up,
+		Clients:    len(wg.Clients),
+	}
+	for _, client := range wg.Clients {
+		if client.Status {
+			status.Active++
+		}
+		if client.Presence(now) == PresenceOnline {
+			status.Online++
+		}
+	}
+	return status
+}
@@ -0,0 +1,168 @@
+package wireguard_go_ubuntu
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// Сессия подключения клиента
+type Session struct {
+	Start    time.Time `json:"start"`    // первое рукопожатие сессии
+	End      time.Time `json:"end"`      // последнее рукопожатие сессии
+	Endpoint string    `json:"endpoint"` // публичный адрес клиента
+	Rx       uint64    `json:"rx"`
+	Tx       uint64    `json:"tx"`
+	Active   bool      `json:"active"`
+}
+
+// Журнал сессий клиентов, построенный по рукопожатиям, адресам и счётчикам
+type SessionTracker struct {
+	mu       sync.Mutex
+	Sessions map[int][]Session      `json:"sessions"`
+	Counters map[string]PeerTraffic `json:"counters"` // последние значения счётчиков по публичному ключу
+
+	Retention time.Duration `json:"-"` // сколько хранить завершённые сессии
+}
+
+const DefaultSessionRetention = 90 * 24 * time.Hour
+
+func NewSessionTracker() *SessionTracker {
+	return &SessionTracker{
+		Sessions:  make(map[int][]Session),
+		Counters:  make(map[string]PeerTraffic),
+		Retention: DefaultSessionRetention,
+	}
+}
+
+// Учёт очередного среза CollectPeerStats.
+// Сессия закрывается, если рукопожатий не было дольше OnlineThreshold
+// или клиент сменил публичный адрес.
+func (t *SessionTracker) Observe(now time.Time, stats map[string]PeerStats, keys map[string]int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for key, peer := range stats {
+		id, ok := keys[key]
+		if !ok {
+			continue
+		}
+		prev, seen := t.Counters[key]
+		t.Counters[key] = PeerTraffic{TrafficRx: peer.TransferRx, TrafficTx: peer.TransferTx}
+
+		var rx, tx uint64
+		if seen {
+			rx, tx = counterDelta(prev.TrafficRx, peer.TransferRx), counterDelta(prev.TrafficTx, peer.TransferTx)
+		}
+
+		sessions := t.Sessions[id]
+		var open *Session
+		if n := len(sessions); n > 0 && sessions[n-1].Active {
+			open = &sessions[n-1]
+		}
+
+		handshake := peer.LatestHandshake
+		switch {
+		case handshake.IsZero() || (open != nil && !handshake.After(open.End)):
+			// Нового рукопожатия нет, трафик относится к открытой сессии
+			if open != nil {
+				open.Rx += rx
+				open.Tx += tx
+			}
+		case open != nil && peer.Endpoint == open.Endpoint && handshake.Sub(open.End) <= OnlineThreshold:
+			open.End = handshake
+			open.Rx += rx
+			open.Tx += tx
+		case now.Sub(handshake) <= OnlineThreshold:
+			if open != nil {
+				open.Active = false
+			}
+			sessions = append(sessions, Session{
+				Start:    handshake,
+				End:      handshake,
+				Endpoint: peer.Endpoint,
+				Rx:       rx,
+				Tx:       tx,
+				Active:   true,
+			})
+		}
+		t.Sessions[id] = sessions
+	}
+
+	t.expire(now)
+}
+
+// Закрытие сессий без рукопожатий и удаление устаревших
+func (t *SessionTracker) expire(now time.Time) {
+	cutoff := now.Add(-t.Retention)
+	for id, sessions := range t.Sessions {
+		var keep []Session
+		for _, s := range sessions {
+			if s.Active && now.Sub(s.End) > OnlineThreshold {
+				s.Active = false
+			}
+			if !s.Active && s.End.Before(cutoff) {
+				continue
+			}
+			keep = append(keep, s)
+		}
+		if len(keep) == 0 {
+			delete(t.Sessions, id)
+			continue
+		}
+		t.Sessions[id] = keep
+	}
+}
+
+// Сессии клиента, пересекающиеся с интервалом [from, to)
+func (t *SessionTracker) ClientSessions(id int, from, to time.Time) []Session {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	result := []Session{}
+	for _, s := range t.Sessions[id] {
+		if s.End.Before(from) || !s.Start.Before(to) {
+			continue
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
+// Сохранение журнала сессий в JSON файл
+func (t *SessionTracker) SaveToFile(filename string) error {
+	t.mu.Lock()
+	data, err := json.Marshal(t)
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// В журнале адреса и время подключений клиентов
+	return writePrivateFile(filename, data)
+}
+
+// Загрузка журнала сессий из JSON файла
+func (t *SessionTracker) LoadFromFile(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := json.Unmarshal(data, t); err != nil {
+		return err
+	}
+	if t.Sessions == nil {
+		t.Sessions = make(map[int][]Session)
+	}
+	if t.Counters == nil {
+		t.Counters = make(map[string]PeerTraffic)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package wireguard_go_ubuntu
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Версия схемы файла состояния. При переименовании полей или изменении
+// их смысла версия увеличивается и в stateMigrations добавляется миграция.
+const StateSchemaVersion = 1
+
+// Миграция файла состояния на версию Version. Состояние передаётся как
+// разобранный JSON, потому что поля старой версии могут не совпадать с
+// текущей структурой; числа приходят как json.Number.
+type stateMigration struct {
+	Version     int
+	Description string
+	Migrate     func(state map[string]interface{}) error
+}
+
+// Миграции по возрастанию версии
+var stateMigrations = []stateMigration{
+	{
+		Version:     1,
+		Description: "schema_version field added, layout unchanged",
+		Migrate:     func(state map[string]interface{}) error { return nil },
+	},
+}
+
+// Версия схемы данных состояния; файлы без поля — версия 0
+func stateSchemaOf(data []byte) (int, error) {
+	var header struct {
+		SchemaVersion int `json:"schema_version"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return 0, err
+	}
+	return header.SchemaVersion, nil
+}
+
+// Приведение данных состояния к текущей версии схемы. Файлы более новой
+// версии не читаются: их поля могли изменить смысл.
+func migrateState(data []byte) ([]byte, int, error) {
+	version, err := stateSchemaOf(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	if version > StateSchemaVersion {
+		return nil, version, fmt.Errorf("state schema %d is newer than supported %d, upgrade wgmanager", version, StateSchemaVersion)
+	}
+	if version == StateSchemaVersion {
+		return data, version, nil
+	}
+
+	var state map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&state); err != nil {
+		return nil, version, err
+	}
+	for _, m := range stateMigrations {
+		if m.Version <= version {
+			continue
+		}
+		if err := m.Migrate(state); err != nil {
+			return nil, version, fmt.Errorf("state migration to schema %d (%s): %v", m.Version, m.Description, err)
+		}
+		state["schema_version"] = m.Version
+	}
+	migrated, err := json.MarshalIndent(state, "", "  ")
+	return migrated, version, err
+}
+
+// Копия файла состояния до миграции: <file>.v<версия>.bak, при повторе
+// с меткой времени, чтобы не затереть прежнюю копию
+func backupStateFile(filename string, data []byte, version int) (string, error) {
+	path := fmt.Sprintf("%s.v%d.bak", filename, version)
+	if _, err := os.Stat(path); err == nil {
+		path = fmt.Sprintf("%s.v%d.%s.bak", filename, version, time.Now().UTC().Format("20060102-150405"))
+	}
+	return path, os.WriteFile(path, data, 0600)
+}
@@ -0,0 +1,100 @@
+package wireguard_go_ubuntu
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrateState(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        string
+		wantVersion int
+		wantErr     string
+	}{
+		{name: "version 0", data: `{"listen_port":"51820","clients":{"2":{"id":2}}}`, wantVersion: 0},
+		{name: "current version", data: `{"schema_version":1,"listen_port":"51820"}`, wantVersion: 1},
+		{name: "newer version", data: `{"schema_version":99}`, wantVersion: 99, wantErr: "newer than supported"},
+		{name: "invalid JSON", data: `{`, wantErr: "unexpected end"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			migrated, version, err := migrateState([]byte(tt.data))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("migrateState() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("migrateState() error = %v", err)
+			}
+			if version != tt.wantVersion {
+				t.Errorf("version = %d, want %d", version, tt.wantVersion)
+			}
+			var state WireGuardConfig
+			if err := json.Unmarshal(migrated, &state); err != nil {
+				t.Fatalf("migrated state: %v", err)
+			}
+			if state.SchemaVersion != StateSchemaVersion {
+				t.Errorf("schema_version = %d, want %d", state.SchemaVersion, StateSchemaVersion)
+			}
+			if state.ListenPort != "51820" {
+				t.Errorf("listen_port = %q, want 51820", state.ListenPort)
+			}
+		})
+	}
+}
+
+func TestLoadFromFileMigration(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "wg_state.json")
+	original := []byte(`{"listen_port":"51820","clients":{"2":{"id":2}}}`)
+	if err := os.WriteFile(filename, original, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg WireGuardConfig
+	if err := wg.LoadFromFile(filename); err != nil {
+		t.Fatalf("LoadFromFile: %v", err)
+	}
+	if !wg.migrated || wg.ListenPort != "51820" || len(wg.Clients) != 1 {
+		t.Fatalf("loaded state = %+v, migrated %v", wg, wg.migrated)
+	}
+	backup, err := os.ReadFile(filename + ".v0.bak")
+	if err != nil || string(backup) != string(original) {
+		t.Fatalf("backup = %q, %v; want the original file", backup, err)
+	}
+
+	if err := wg.SaveToFile(filename); err != nil {
+		t.Fatal(err)
+	}
+	var reloaded WireGuardConfig
+	if err := reloaded.LoadFromFile(filename); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.migrated || reloaded.SchemaVersion != StateSchemaVersion {
+		t.Errorf("saved state is migrated again: schema %d", reloaded.SchemaVersion)
+	}
+	if matches, _ := filepath.Glob(filename + ".v*.bak"); len(matches) != 1 {
+		t.Errorf("backups = %v, want one", matches)
+	}
+}
+
+func TestLoadFromFileNewerSchema(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "wg_state.json")
+	if err := os.WriteFile(filename, []byte(`{"schema_version":99,"listen_port":"1"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var wg WireGuardConfig
+	err := wg.LoadFromFile(filename)
+	if err == nil || !strings.Contains(err.Error(), "newer than supported") {
+		t.Fatalf("LoadFromFile() error = %v, want newer schema", err)
+	}
+	if wg.ListenPort != "" {
+		t.Errorf("state was loaded from a newer schema")
+	}
+}
@@ -0,0 +1,141 @@
+package wireguard_go_ubuntu
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// Что провижининг создал на хосте. По этой записи DropWireguard удаляет только
+// созданное им и не трогает то, что было настроено до него.
+type ProvisionRecord struct {
+	At              time.Time `json:"at"`                // последний успешный провижининг, нулевое — записи нет
+	KeyFiles        bool      `json:"key_files"`         // файлы ключей сервера созданы провижинингом
+	ConfigFile      bool      `json:"config_file"`       // wg0.conf создан провижинингом
+	SysctlLine      bool      `json:"sysctl_line"`       // строка ip_forward добавлена в sysctl.conf
+	IPForwardBefore string    `json:"ip_forward_before"` // значение ip_forward до включения, пусто — не менялось
+	UfwRule         string    `json:"ufw_rule"`          // добавленное правило ufw, пусто — не добавлялось
+	UnitEnabled     bool      `json:"unit_enabled"`      // wg-quick@wg0 включён провижинингом
+}
+
+// Запись для установок, созданных до появления ProvisionRecord: считаем,
+// что всё создано провижинингом, как и удаляла прежняя версия.
+func (wg *WireGuardConfig) legacyProvisionRecord() ProvisionRecord {
+	record := ProvisionRecord{KeyFiles: true, ConfigFile: true, SysctlLine: true, UnitEnabled: true}
+	if wg.ListenPort != "" {
+		record.UfwRule = wg.ListenPort + "/udp"
+	}
+	return record
+}
+
+// Удаление сервера: отмена того, что создал провижининг, по записи Provisioned.
+// backup, если задан, выполняется первым; при его ошибке хост не меняется.
+// Остальные шаги независимы: ошибка одного не останавливает следующие, итог
+// каждого записан в журнале. Файлы каталога состояния и клиенты не удаляются.
+func (wg *WireGuardConfig) DropWireguard(backup func() error) (*Journal, error) {
+	j := NewJournal("teardown")
+	if backup != nil {
+		err := j.Do("backup", func() (func() error, error) { return nil, backup() })
+		if err != nil {
+			return j, j.Report(err)
+		}
+	}
+
+	record := wg.Provisioned
+	if record.At.IsZero() {
+		record = wg.legacyProvisionRecord()
+	}
+	var errs []error
+	step := func(name string, needed bool, reason string, do func() error) {
+		if !needed {
+			j.Skip(name, reason)
+			return
+		}
+		if err := j.Do(name, func() (func() error, error) { return nil, do() }); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// При остановке PostDown удаляет правила iptables
+	step("stop wg-quick@wg0", wireguardActive(), "not running", func() error {
+		return runCommand("systemctl", "stop", "wg-quick@wg0.service")
+	})
+	step("disable wg-quick@wg0", record.UnitEnabled, "enabled before provisioning", func() error {
+		return runCommand("systemctl", "disable", "wg-quick@wg0.service")
+	})
+	leftover, reason := wg.leftoverNATRules()
+	step("remove iptables rules", len(leftover) > 0, reason, func() error {
+		for _, rule := range leftover {
+			if err := runCommand("iptables", rule...); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	_, ufwErr := exec.LookPath("ufw")
+	ufwStep, ufwReason := "ufw delete allow", "not added by provisioning"
+	if record.UfwRule != "" {
+		ufwStep += " " + record.UfwRule
+		if ufwErr != nil {
+			ufwReason = "ufw is not installed"
+		}
+	}
+	step(ufwStep, record.UfwRule != "" && ufwErr == nil, ufwReason, func() error {
+		return runCommand("ufw", "delete", "allow", record.UfwRule)
+	})
+	step("remove "+ipForwardLine, record.SysctlLine, "not added by provisioning", func() error {
+		return removeLine(sysctlFile, ipForwardLine)
+	})
+	step("restore ip forwarding", record.IPForwardBefore != "", "not changed by provisioning", func() error {
+		return runCommand("sysctl", "-w", "net.ipv4.ip_forward="+record.IPForwardBefore)
+	})
+	step("remove "+wgConfigFile, record.ConfigFile, "existed before provisioning", func() error {
+		return removeFiles(wgConfigFile)
+	})
+	step("remove server keys", record.KeyFiles, "existed before provisioning", func() error {
+		return removeFiles(serverPrivateKeyFile, serverPublicKeyFile)
+	})
+
+	err := errors.Join(errs...)
+	if err == nil {
+		wg.PrivateKey, wg.PublicKey = "", ""
+		wg.ListenPort, wg.Endpoint, wg.InterName = "", "", ""
+		wg.Address, wg.InterfaceConf = "", ""
+		wg.Provisioned = ProvisionRecord{}
+	}
+	return j, j.Report(err)
+}
+
+// Правила iptables из PostUp, оставшиеся после остановки интерфейса, в виде
+// аргументов для удаления. Правило FORWARD для wg0 принадлежит только нам;
+// если оно осталось, PostDown не выполнялся, и MASQUERADE тоже удаляется.
+func (wg *WireGuardConfig) leftoverNATRules() ([][]string, string) {
+	if _, err := exec.LookPath("iptables"); err != nil {
+		return nil, "iptables is not installed"
+	}
+	forward := []string{"FORWARD", "-i", "wg0", "-j", "ACCEPT"}
+	if exec.Command("iptables", append([]string{"-C"}, forward...)...).Run() != nil {
+		return nil, "removed by PostDown"
+	}
+	rules := [][]string{append([]string{"-D"}, forward...)}
+	if wg.InterName != "" {
+		nat := []string{"POSTROUTING", "-o", wg.InterName, "-j", "MASQUERADE"}
+		if exec.Command("iptables", append([]string{"-t", "nat", "-C"}, nat...)...).Run() == nil {
+			rules = append(rules, append([]string{"-t", "nat", "-D"}, nat...))
+		}
+	}
+	return rules, ""
+}
+
+// Удаление файлов; отсутствующие пропускаются
+func removeFiles(paths ...string) error {
+	var errs []error
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, fmt.Errorf("failed to remove %s: %v", path, err))
+		}
+	}
+	return errors.Join(errs...)
+}
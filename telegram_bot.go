@@ -0,0 +1,351 @@
+package wireguard_go_ubuntu
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/telebot.v3"
+)
+
+// Общий экземпляр бота: используется интерактивным ботом и отправкой конфигураций
+var (
+	tgBotMu      sync.Mutex
+	tgBot        *telebot.Bot
+	tgBotRunning bool // запущен ли опрос обновлений: Stop без Start блокируется
+)
+
+// Бот для токена, создаётся один раз и переиспользуется
+func telegramBot(token string) (*telebot.Bot, error) {
+	tgBotMu.Lock()
+	defer tgBotMu.Unlock()
+
+	if tgBot != nil && tgBot.Token == token {
+		return tgBot, nil
+	}
+	bot, err := telebot.NewBot(telebot.Settings{
+		Token:  token,
+		Poller: &telebot.LongPoller{Timeout: 10 * time.Second},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bot: %v", err)
+	}
+	tgBot = bot
+	return bot, nil
+}
+
+// Документ с конфигурацией клиента
+func configDocument(client Client) *telebot.Document {
+	return &telebot.Document{
+		File:     telebot.FromReader(strings.NewReader(client.Config)),
+		FileName: "wgconf.conf",
+		Caption:  "WireGuard Configuration",
+	}
+}
+
+// Отправка конфигурации клиента в чат с записью в журнал аудита: в ней
+// приватный ключ клиента
+func sendConfigDocument(c telebot.Context, client Client) error {
+	if err := c.Send(configDocument(client)); err != nil {
+		return err
+	}
+	auditAction(botActor(c), AuditClientConfigDownload, client.Id, map[string]string{"format": ConfigFormatWgQuick}, nil, nil)
+	return nil
+}
+
+// Фото с QR-кодом конфигурации клиента
+func configQRPhoto(client Client) (*telebot.Photo, error) {
+	png, err := ConfigQRPNG(client, DefaultQRSize)
+	if err != nil {
+		return nil, err
+	}
+	return &telebot.Photo{
+		File:    telebot.FromReader(bytes.NewReader(png)),
+		Caption: fmt.Sprintf("QR-код конфигурации клиента %d", client.Id),
+	}, nil
+}
+
+// Запуск интерактивного бота, блокирует до StopTelegramBot
+func RunTelegramBot() error {
+	clMu.Lock()
+	token := cl.BotToken
+	clMu.Unlock()
+	if token == "" {
+		return fmt.Errorf("telegram bot token is not configured")
+	}
+
+	bot, err := telegramBot(token)
+	if err != nil {
+		return err
+	}
+
+	// Команды пользователя
+	bot.Handle("/start", botStart)
+	bot.Handle("/config", botConfig)
+	bot.Handle("/qr", botQR)
+	bot.Handle("/status", botStatus)
+	bot.Handle("/usage", botUsage)
+
+	// Команды администратора
+	admin := bot.Group()
+	admin.Use(botAdminOnly)
+	admin.Handle("/add", botAdd)
+	admin.Handle("/stop", botClientAction(stopClient, "остановлен"))
+	admin.Handle("/activate", botClientAction(activateClient, "активирован"))
+	admin.Handle("/delete", botClientAction(deleteClient, "удалён"))
+	admin.Handle("/list", botList)
+	admin.Handle("/link", botLink)
+
+	tgBotMu.Lock()
+	tgBotRunning = true
+	tgBotMu.Unlock()
+	bot.Start()
+	return nil
+}
+
+// Остановка интерактивного бота
+func StopTelegramBot() {
+	tgBotMu.Lock()
+	bot, running := tgBot, tgBotRunning
+	tgBotRunning = false
+	tgBotMu.Unlock()
+	if bot != nil && running {
+		bot.Stop()
+	}
+}
+
+// Является ли пользователь администратором
+func isBotAdmin(tgID int64) bool {
+	clMu.Lock()
+	defer clMu.Unlock()
+	for _, id := range cl.AdminTgIds {
+		if int64(id) == tgID {
+			return true
+		}
+	}
+	return false
+}
+
+// Клиенты, привязанные к пользователю Telegram
+func clientsByTgId(tgID int64) []Client {
+	clMu.Lock()
+	defer clMu.Unlock()
+
+	var clients []Client
+	for _, client := range cl.Clients {
+		if int64(client.TgId) == tgID {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+// Инициатор действия для журнала аудита
+func botActor(c telebot.Context) Actor {
+	return Actor{Type: ActorBot, ID: strconv.FormatInt(c.Sender().ID, 10)}
+}
+
+func botAdminOnly(next telebot.HandlerFunc) telebot.HandlerFunc {
+	return func(c telebot.Context) error {
+		if !isBotAdmin(c.Sender().ID) {
+			return c.Send("Команда доступна только администраторам")
+		}
+		return next(c)
+	}
+}
+
+// ------------------------ команды пользователя ------------------------
+func botStart(c telebot.Context) error {
+	// Переход по ссылке t.me/<бот>?start=<код>
+	if code := c.Message().Payload; code != "" {
+		client, err := redeemLinkCode(code, c.Sender().ID)
+		if err != nil {
+			return c.Send("Ссылка недействительна или уже использована")
+		}
+		if err := c.Send(fmt.Sprintf("Аккаунт привязан к клиенту %d", client.Id)); err != nil {
+			return err
+		}
+		return sendConfigDocument(c, client)
+	}
+
+	text := "Бот WireGuard.\n" +
+		"/config — получить конфигурацию\n" +
+		"/qr — QR-код конфигурации для мобильного приложения\n" +
+		"/status — состояние подключения\n" +
+		"/usage — использованный трафик"
+	if isBotAdmin(c.Sender().ID) {
+		text += "\n\nАдминистратор:\n" +
+			"/add <id> [имя] — добавить клиента\n" +
+			"/stop <id>, /activate <id>, /delete <id>\n" +
+			"/link <id> — ссылка для привязки аккаунта\n" +
+			"/list — все клиенты"
+	}
+	return c.Send(text)
+}
+
+func botConfig(c telebot.Context) error {
+	clients := clientsByTgId(c.Sender().ID)
+	if len(clients) == 0 {
+		return c.Send("К вашему аккаунту не привязано ни одного клиента")
+	}
+	for _, client := range clients {
+		if err := sendConfigDocument(c, client); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func botQR(c telebot.Context) error {
+	clients := clientsByTgId(c.Sender().ID)
+	if len(clients) == 0 {
+		return c.Send("К вашему аккаунту не привязано ни одного клиента")
+	}
+	for _, client := range clients {
+		photo, err := configQRPhoto(client)
+		if err != nil {
+			return c.Send(fmt.Sprintf("Ошибка создания QR-кода: %v", err))
+		}
+		if err := c.Send(photo); err != nil {
+			return err
+		}
+		auditAction(botActor(c), AuditClientConfigDownload, client.Id, map[string]string{"format": "qr"}, nil, nil)
+	}
+	return nil
+}
+
+func botStatus(c telebot.Context) error {
+	refreshPresence()
+	clients := clientsByTgId(c.Sender().ID)
+	if len(clients) == 0 {
+		return c.Send("К вашему аккаунту не привязано ни одного клиента")
+	}
+
+	now := time.Now()
+	var b strings.Builder
+	for _, client := range clients {
+		stat := "остановлен"
+		if client.Status {
+			stat = "активен"
+		}
+		fmt.Fprintf(&b, "Клиент %d: %s, подключение %s", client.Id, stat, client.Presence(now))
+		if !client.LastSeen.IsZero() {
+			fmt.Fprintf(&b, ", последнее рукопожатие %s", client.LastSeen.Format("2006-01-02 15:04"))
+		}
+		b.WriteString("\n")
+	}
+	return c.Send(b.String())
+}
+
+func botUsage(c telebot.Context) error {
+	clients := clientsByTgId(c.Sender().ID)
+	if len(clients) == 0 {
+		return c.Send("К вашему аккаунту не привязано ни одного клиента")
+	}
+
+	now := time.Now().UTC()
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	var b strings.Builder
+	for _, client := range clients {
+		var rx, tx uint64
+		for _, row := range history.Usage(client.Id, monthStart, now.Add(time.Second), "monthly") {
+			rx += row.Rx
+			tx += row.Tx
+		}
+		fmt.Fprintf(&b, "Клиент %d за %s: получено %s, отправлено %s\n",
+			client.Id, monthStart.Format("2006-01"), FormatBytes(tx), FormatBytes(rx))
+	}
+	return c.Send(b.String())
+}
+
+// ------------------------ команды администратора ------------------------
+func botAdd(c telebot.Context) error {
+	args := c.Args()
+	if len(args) < 1 {
+		return c.Send("Использование: /add <id> [имя]")
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return c.Send("Некорректный id клиента")
+	}
+
+	client, err := addClient(botActor(c), id, strings.Join(args[1:], " "))
+	if err != nil {
+		return c.Send(fmt.Sprintf("Ошибка добавления клиента: %v", err))
+	}
+	if err := c.Send(fmt.Sprintf("Клиент %d добавлен, адрес %s", client.Id, client.AddressClient)); err != nil {
+		return err
+	}
+	return sendConfigDocument(c, client)
+}
+
+// Команда администратора над клиентом по id
+func botClientAction(action func(actor Actor, id int) error, done string) telebot.HandlerFunc {
+	return func(c telebot.Context) error {
+		args := c.Args()
+		if len(args) != 1 {
+			return c.Send("Укажите id клиента")
+		}
+		id, err := strconv.Atoi(args[0])
+		if err != nil {
+			return c.Send("Некорректный id клиента")
+		}
+
+		clMu.Lock()
+		_, exists := cl.Clients[id]
+		clMu.Unlock()
+		if !exists {
+			return c.Send(fmt.Sprintf("Клиент с id %d не найден", id))
+		}
+
+		if err := action(botActor(c), id); err != nil {
+			return c.Send(fmt.Sprintf("Ошибка: %v", err))
+		}
+		return c.Send(fmt.Sprintf("Клиент %d %s", id, done))
+	}
+}
+
+func botLink(c telebot.Context) error {
+	args := c.Args()
+	if len(args) != 1 {
+		return c.Send("Использование: /link <id>")
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return c.Send("Некорректный id клиента")
+	}
+
+	link, url, err := createLinkCode(botActor(c), id, DefaultLinkCodeTTL)
+	if err != nil {
+		return c.Send(fmt.Sprintf("Ошибка создания ссылки: %v", err))
+	}
+	return c.Send(fmt.Sprintf("Ссылка для клиента %d, действует до %s:\n%s", id, link.ExpiresAt.Format("2006-01-02 15:04"), url))
+}
+
+func botList(c telebot.Context) error {
+	refreshPresence()
+	clMu.Lock()
+	text := cl.AllClients()
+	clMu.Unlock()
+	if text == "" {
+		text = "Клиентов нет"
+	}
+	return c.Send(text)
+}
+
+// Размер в удобочитаемом виде
+func FormatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.2f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,76 @@
+package wireguard_go_ubuntu
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// Срок действия кода привязки по умолчанию
+const DefaultLinkCodeTTL = 24 * time.Hour
+
+// Одноразовый код привязки Telegram аккаунта к клиенту
+type LinkCode struct {
+	Code      string    `json:"code"`
+	ClientID  int       `json:"client_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Ссылка на бота с кодом привязки
+func DeepLink(botUsername, code string) string {
+	return fmt.Sprintf("https://t.me/%s?start=%s", botUsername, code)
+}
+
+// Создание кода привязки для клиента
+func (wg *WireGuardConfig) NewLinkCode(clientID int, ttl time.Duration, now time.Time) (LinkCode, error) {
+	if _, exists := wg.Clients[clientID]; !exists {
+		return LinkCode{}, clientNotFound(clientID)
+	}
+	if ttl <= 0 {
+		ttl = DefaultLinkCodeTTL
+	}
+
+	// Telegram допускает в параметре start до 64 символов [A-Za-z0-9_-]
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return LinkCode{}, fmt.Errorf("failed to generate link code: %v", err)
+	}
+
+	wg.purgeLinkCodes(now)
+	if wg.LinkCodes == nil {
+		wg.LinkCodes = make(map[string]LinkCode)
+	}
+	link := LinkCode{Code: hex.EncodeToString(buf), ClientID: clientID, ExpiresAt: now.Add(ttl)}
+	wg.LinkCodes[link.Code] = link
+	return link, nil
+}
+
+// Погашение кода: привязывает Telegram ID к клиенту, код больше не действует
+func (wg *WireGuardConfig) RedeemLinkCode(code string, tgID int64, now time.Time) (Client, error) {
+	link, exists := wg.LinkCodes[code]
+	if !exists {
+		return Client{}, fmt.Errorf("link code not found or already used")
+	}
+	delete(wg.LinkCodes, code)
+	if now.After(link.ExpiresAt) {
+		return Client{}, fmt.Errorf("link code expired")
+	}
+
+	client, exists := wg.Clients[link.ClientID]
+	if !exists {
+		return Client{}, clientNotFound(link.ClientID)
+	}
+	client.TgId = int(tgID)
+	wg.Clients[link.ClientID] = client
+	return client, nil
+}
+
+// Удаление просроченных кодов
+func (wg *WireGuardConfig) purgeLinkCodes(now time.Time) {
+	for code, link := range wg.LinkCodes {
+		if now.After(link.ExpiresAt) {
+			delete(wg.LinkCodes, code)
+		}
+	}
+}
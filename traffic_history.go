@@ -0,0 +1,283 @@
+package wireguard_go_ubuntu
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Точка временного ряда: приращение трафика клиента за интервал
+type TrafficPoint struct {
+	Time time.Time `json:"time"`
+	Rx   uint64    `json:"rx"`
+	Tx   uint64    `json:"tx"`
+}
+
+// Строка отчёта об использовании трафика
+type UsageRow struct {
+	ClientID int    `json:"client_id"`
+	Period   string `json:"period"`
+	Rx       uint64 `json:"rx"`
+	Tx       uint64 `json:"tx"`
+	Total    uint64 `json:"total"`
+}
+
+// История трафика клиентов с прореживанием raw -> hourly -> daily
+type TrafficHistory struct {
+	mu       sync.Mutex
+	Raw      map[int][]TrafficPoint `json:"raw"`
+	Hourly   map[int][]TrafficPoint `json:"hourly"`
+	Daily    map[int][]TrafficPoint `json:"daily"`
+	Counters map[string]PeerTraffic `json:"counters"` // последние значения счётчиков по публичному ключу
+
+	RawRetention    time.Duration `json:"-"` // сколько хранить сырые точки до свёртки в часовые
+	HourlyRetention time.Duration `json:"-"` // сколько хранить часовые точки до свёртки в дневные
+}
+
+const (
+	DefaultRawRetention    = 48 * time.Hour
+	DefaultHourlyRetention = 90 * 24 * time.Hour
+)
+
+// Создание пустой истории трафика
+func NewTrafficHistory() *TrafficHistory {
+	return &TrafficHistory{
+		Raw:             make(map[int][]TrafficPoint),
+		Hourly:          make(map[int][]TrafficPoint),
+		Daily:           make(map[int][]TrafficPoint),
+		Counters:        make(map[string]PeerTraffic),
+		RawRetention:    DefaultRawRetention,
+		HourlyRetention: DefaultHourlyRetention,
+	}
+}
+
+// Индекс публичных ключей клиентов: ключ -> id клиента
+func (wg *WireGuardConfig) ClientKeys() map[string]int {
+	keys := make(map[string]int, len(wg.Clients))
+	for id, client := range wg.Clients {
+		if client.PublicClientKey != "" {
+			keys[client.PublicClientKey] = id
+		}
+	}
+	return keys
+}
+
+// Запись очередного среза счётчиков из CollectTraffic.
+// Счётчики wg накопительные и обнуляются при перезапуске интерфейса,
+// поэтому в историю пишется разница с предыдущим срезом.
+func (h *TrafficHistory) Record(now time.Time, traffic map[string]PeerTraffic, keys map[string]int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for key, cur := range traffic {
+		id, ok := keys[key]
+		if !ok {
+			continue
+		}
+		prev, seen := h.Counters[key]
+		h.Counters[key] = cur
+		if !seen {
+			// Первый срез пира только задаёт точку отсчёта
+			continue
+		}
+
+		rx, tx := counterDelta(prev.TrafficRx, cur.TrafficRx), counterDelta(prev.TrafficTx, cur.TrafficTx)
+		if rx == 0 && tx == 0 {
+			continue
+		}
+		h.Raw[id] = append(h.Raw[id], TrafficPoint{Time: now.UTC(), Rx: rx, Tx: tx})
+	}
+
+	h.compact(now)
+}
+
+// Разница накопительного счётчика с учётом его сброса
+func counterDelta(prev, cur uint64) uint64 {
+	if cur < prev {
+		return cur
+	}
+	return cur - prev
+}
+
+// Свёртка устаревших точек в более грубые интервалы
+func (h *TrafficHistory) compact(now time.Time) {
+	rawCutoff := now.Add(-h.RawRetention)
+	for id, points := range h.Raw {
+		var keep []TrafficPoint
+		for _, p := range points {
+			if p.Time.Before(rawCutoff) {
+				h.Hourly[id] = mergePoint(h.Hourly[id], p, p.Time.Truncate(time.Hour))
+			} else {
+				keep = append(keep, p)
+			}
+		}
+		h.Raw[id] = keep
+	}
+
+	hourlyCutoff := now.Add(-h.HourlyRetention)
+	for id, points := range h.Hourly {
+		var keep []TrafficPoint
+		for _, p := range points {
+			if p.Time.Before(hourlyCutoff) {
+				h.Daily[id] = mergePoint(h.Daily[id], p, dayStart(p.Time))
+			} else {
+				keep = append(keep, p)
+			}
+		}
+		h.Hourly[id] = keep
+	}
+}
+
+// Добавление точки в интервал bucket (точки идут по возрастанию времени)
+func mergePoint(points []TrafficPoint, p TrafficPoint, bucket time.Time) []TrafficPoint {
+	if n := len(points); n > 0 && points[n-1].Time.Equal(bucket) {
+		points[n-1].Rx += p.Rx
+		points[n-1].Tx += p.Tx
+		return points
+	}
+	return append(points, TrafficPoint{Time: bucket, Rx: p.Rx, Tx: p.Tx})
+}
+
+func dayStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// Ключ периода для отчёта: "2006-01-02" для daily, "2006-01" для monthly
+func periodKey(t time.Time, period string) string {
+	if period == "monthly" {
+		return t.UTC().Format("2006-01")
+	}
+	return t.UTC().Format("2006-01-02")
+}
+
+// Использование трафика клиентом за [from, to) с разбивкой по дням или месяцам
+func (h *TrafficHistory) Usage(id int, from, to time.Time, period string) []UsageRow {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.usage(id, from, to, period)
+}
+
+func (h *TrafficHistory) usage(id int, from, to time.Time, period string) []UsageRow {
+	totals := make(map[string]*UsageRow)
+	for _, series := range []map[int][]TrafficPoint{h.Daily, h.Hourly, h.Raw} {
+		for _, p := range series[id] {
+			if p.Time.Before(from) || !p.Time.Before(to) {
+				continue
+			}
+			key := periodKey(p.Time, period)
+			row, ok := totals[key]
+			if !ok {
+				row = &UsageRow{ClientID: id, Period: key}
+				totals[key] = row
+			}
+			row.Rx += p.Rx
+			row.Tx += p.Tx
+			row.Total += p.Rx + p.Tx
+		}
+	}
+
+	rows := make([]UsageRow, 0, len(totals))
+	for _, row := range totals {
+		rows = append(rows, *row)
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Period < rows[j].Period })
+	return rows
+}
+
+// Суточное использование всех клиентов за [from, to) для выгрузки
+func (h *TrafficHistory) Export(from, to time.Time) []UsageRow {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ids := make(map[int]struct{})
+	for _, series := range []map[int][]TrafficPoint{h.Daily, h.Hourly, h.Raw} {
+		for id := range series {
+			ids[id] = struct{}{}
+		}
+	}
+
+	var rows []UsageRow
+	for id := range ids {
+		rows = append(rows, h.usage(id, from, to, "daily")...)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Period != rows[j].Period {
+			return rows[i].Period < rows[j].Period
+		}
+		return rows[i].ClientID < rows[j].ClientID
+	})
+	return rows
+}
+
+// Выгрузка строк отчёта в CSV
+func UsageCSV(rows []UsageRow) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if err := w.Write([]string{"client_id", "period", "rx_bytes", "tx_bytes", "total_bytes"}); err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		record := []string{
+			strconv.Itoa(row.ClientID),
+			row.Period,
+			strconv.FormatUint(row.Rx, 10),
+			strconv.FormatUint(row.Tx, 10),
+			strconv.FormatUint(row.Total, 10),
+		}
+		if err := w.Write(record); err != nil {
+			return nil, err
+		}
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// Сохранение истории трафика в JSON файл
+func (h *TrafficHistory) SaveToFile(filename string) error {
+	h.mu.Lock()
+	data, err := json.Marshal(h)
+	h.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// История показывает использование каждого клиента
+	return writePrivateFile(filename, data)
+}
+
+// Загрузка истории трафика из JSON файла
+func (h *TrafficHistory) LoadFromFile(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := json.Unmarshal(data, h); err != nil {
+		return err
+	}
+	// Пустые разделы в файле приходят как nil
+	if h.Raw == nil {
+		h.Raw = make(map[int][]TrafficPoint)
+	}
+	if h.Hourly == nil {
+		h.Hourly = make(map[int][]TrafficPoint)
+	}
+	if h.Daily == nil {
+		h.Daily = make(map[int][]TrafficPoint)
+	}
+	if h.Counters == nil {
+		h.Counters = make(map[string]PeerTraffic)
+	}
+	return nil
+}
@@ -0,0 +1,331 @@
+package wireguard_go_ubuntu
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// События жизненного цикла клиента
+const (
+	LifecycleClientCreated   = "client.created"
+	LifecycleClientActivated = "client.activated"
+	LifecycleClientStopped   = "client.stopped"
+	LifecycleClientDeleted   = "client.deleted"
+	LifecycleClientExpired   = "client.expired"
+)
+
+// Состояния доставки
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+const (
+	// Число попыток доставки до перевода в failed
+	WebhookMaxAttempts = 10
+	// Первая задержка повтора, далее удваивается до webhookMaxBackoff
+	webhookBaseBackoff = 30 * time.Second
+	webhookMaxBackoff  = 6 * time.Hour
+	// Сколько завершённых доставок хранить в журнале
+	webhookLogSize = 1000
+)
+
+// Подписка на события
+type WebhookEndpoint struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"` // ключ подписи HMAC-SHA256
+	Events []string `json:"events"` // пусто — все события
+}
+
+// Событие, отправляемое в webhook
+type WebhookEvent struct {
+	ID     string     `json:"id"`
+	Type   string     `json:"type"`
+	Time   time.Time  `json:"time"`
+	Reason string     `json:"reason,omitempty"`
+	Client ClientInfo `json:"client"`
+}
+
+// Доставка события на один адрес
+type WebhookDelivery struct {
+	ID          string          `json:"id"`
+	EventID     string          `json:"event_id"`
+	EventType   string          `json:"event_type"`
+	URL         string          `json:"url"`
+	Secret      string          `json:"-"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"next_attempt"`
+	LastStatus  int             `json:"last_status"` // HTTP код последней попытки
+	LastError   string          `json:"last_error"`
+	InFlight    bool            `json:"in_flight,omitempty"` // запрос выполняется
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+}
+
+// Очередь webhook с повторами, сохраняется между перезапусками
+type WebhookQueue struct {
+	mu      sync.Mutex
+	Pending []WebhookDelivery `json:"pending"`
+	Log     []WebhookDelivery `json:"log"` // завершённые доставки, новые в конце
+
+	client *http.Client
+}
+
+// Очередь хранит секрет, чтобы подписывать повторы после перезапуска
+type storedDelivery struct {
+	WebhookDelivery
+	Secret string `json:"secret"`
+}
+
+func NewWebhookQueue() *WebhookQueue {
+	return &WebhookQueue{client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Подписан ли адрес на событие
+func (e WebhookEndpoint) wants(eventType string) bool {
+	if len(e.Events) == 0 {
+		return true
+	}
+	for _, t := range e.Events {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func randomID() string {
+	buf := make([]byte, 12)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// Постановка события в очередь для всех подписанных адресов
+func (q *WebhookQueue) Enqueue(endpoints []WebhookEndpoint, event WebhookEvent) error {
+	if event.ID == "" {
+		event.ID = randomID()
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, endpoint := range endpoints {
+		if !endpoint.wants(event.Type) {
+			continue
+		}
+		q.Pending = append(q.Pending, WebhookDelivery{
+			ID:          randomID(),
+			EventID:     event.ID,
+			EventType:   event.Type,
+			URL:         endpoint.URL,
+			Secret:      endpoint.Secret,
+			Payload:     payload,
+			Status:      DeliveryPending,
+			NextAttempt: event.Time,
+			CreatedAt:   event.Time,
+			UpdatedAt:   event.Time,
+		})
+	}
+	return nil
+}
+
+// Подпись тела запроса: hex(HMAC-SHA256(secret, timestamp + "." + body))
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Задержка перед попыткой attempt (с единицы)
+func webhookBackoff(attempt int) time.Duration {
+	d := webhookBaseBackoff
+	for i := 1; i < attempt && d < webhookMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > webhookMaxBackoff {
+		d = webhookMaxBackoff
+	}
+	return d
+}
+
+// Отправка одной доставки, возвращает HTTP код
+func (q *WebhookQueue) send(d WebhookDelivery, now time.Time) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, d.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	ts := now.Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Id", d.EventID)
+	req.Header.Set("X-Webhook-Event", d.EventType)
+	req.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(ts, 10))
+	if d.Secret != "" {
+		req.Header.Set("X-Webhook-Signature", "sha256="+SignWebhook(d.Secret, ts, d.Payload))
+	}
+
+	resp, err := q.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// Отправка доставок, у которых подошло время. Возвращает true, если очередь изменилась.
+// Доставки остаются в Pending на время запроса с пометкой InFlight, поэтому
+// сохранение очереди в это время их не теряет; после перезапуска они
+// отправляются повторно.
+func (q *WebhookQueue) ProcessDue(now time.Time) bool {
+	q.mu.Lock()
+	var due []WebhookDelivery
+	for i := range q.Pending {
+		d := &q.Pending[i]
+		if !d.InFlight && !d.NextAttempt.After(now) {
+			d.InFlight = true
+			due = append(due, *d)
+		}
+	}
+	q.mu.Unlock()
+
+	if len(due) == 0 {
+		return false
+	}
+
+	// Запросы выполняются без блокировки, чтобы не задерживать Enqueue
+	for i := range due {
+		d := &due[i]
+		status, err := q.send(*d, now)
+		d.InFlight = false
+		d.Attempts++
+		d.LastStatus = status
+		d.UpdatedAt = now
+		switch {
+		case err == nil:
+			d.Status = DeliveryDelivered
+			d.LastError = ""
+		case d.Attempts >= WebhookMaxAttempts:
+			d.Status = DeliveryFailed
+			d.LastError = err.Error()
+		default:
+			d.LastError = err.Error()
+			d.NextAttempt = now.Add(webhookBackoff(d.Attempts))
+		}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	results := make(map[string]WebhookDelivery, len(due))
+	for _, d := range due {
+		results[d.ID] = d
+	}
+	// Очередь могла быть перезагружена из файла: доставки, которых в ней
+	// больше нет, не возвращаются
+	pending := q.Pending[:0]
+	for _, d := range q.Pending {
+		result, ok := results[d.ID]
+		switch {
+		case !ok:
+			pending = append(pending, d)
+		case result.Status == DeliveryPending:
+			pending = append(pending, result)
+		default:
+			q.Log = append(q.Log, result)
+		}
+	}
+	q.Pending = pending
+	if len(q.Log) > webhookLogSize {
+		q.Log = q.Log[len(q.Log)-webhookLogSize:]
+	}
+	return true
+}
+
+// Журнал доставок: ожидающие и завершённые, новые первыми; status фильтрует по состоянию
+func (q *WebhookQueue) Deliveries(status string) []WebhookDelivery {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	result := []WebhookDelivery{}
+	for i := len(q.Pending) - 1; i >= 0; i-- {
+		if status == "" || status == q.Pending[i].Status {
+			result = append(result, q.Pending[i])
+		}
+	}
+	for i := len(q.Log) - 1; i >= 0; i-- {
+		if status == "" || status == q.Log[i].Status {
+			result = append(result, q.Log[i])
+		}
+	}
+	return result
+}
+
+// Сохранение очереди в JSON файл
+func (q *WebhookQueue) SaveToFile(filename string) error {
+	q.mu.Lock()
+	stored := struct {
+		Pending []storedDelivery  `json:"pending"`
+		Log     []WebhookDelivery `json:"log"`
+	}{Log: q.Log}
+	for _, d := range q.Pending {
+		stored.Pending = append(stored.Pending, storedDelivery{WebhookDelivery: d, Secret: d.Secret})
+	}
+	data, err := json.Marshal(stored)
+	q.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// В файле секреты подписи, поэтому только для владельца
+	return writePrivateFile(filename, data)
+}
+
+// Загрузка очереди из JSON файла
+func (q *WebhookQueue) LoadFromFile(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	stored := struct {
+		Pending []storedDelivery  `json:"pending"`
+		Log     []WebhookDelivery `json:"log"`
+	}{}
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.Pending = nil
+	for _, d := range stored.Pending {
+		d.WebhookDelivery.Secret = d.Secret
+		// Запрос, прерванный остановкой, отправляется заново
+		d.WebhookDelivery.InFlight = false
+		q.Pending = append(q.Pending, d.WebhookDelivery)
+	}
+	q.Log = stored.Log
+	return nil
+}
@@ -4,20 +4,31 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"gopkg.in/telebot.v3"
 	"io/ioutil"
 	"log"
 	"math/rand"
 	"net"
 	"os"
 	"os/exec"
+	"sort"
 	"strconv"
 	"strings"
 	"text/template"
 	"time"
 )
 
+// Конфигурация интерфейса wg0 и ключи сервера
+const (
+	wgConfigFile         = "/etc/wireguard/wg0.conf"
+	serverPrivateKeyFile = "/etc/wireguard/privatekey"
+	serverPublicKeyFile  = "/etc/wireguard/publickey"
+	sysctlFile           = "/etc/sysctl.conf"
+	ipForwardProc        = "/proc/sys/net/ipv4/ip_forward"
+	ipForwardLine        = "net.ipv4.ip_forward=1"
+)
+
 // Структура для конфигурации пира
 type PeerConfig struct {
 	PublicKey  string `json:"public_key"`
@@ -28,46 +39,76 @@ type PeerConfig struct {
 // Структура для клиента
 type Client struct {
 	Id               int        `json:"id"`
+	Name             string     `json:"name"`
 	Status           bool       `json:"status"`
 	AddressClient    string     `json:"address_client"`
 	PubkeyPath       string     `json:"pubkey_path"`
 	PrivkeyPath      string     `json:"privkey_path"`
 	PrivateClientKey string     `json:"private_client_key"`
 	PublicClientKey  string     `json:"public_client_key"`
+	PresharedKey     string     `json:"preshared_key"` // есть только у импортированных клиентов
 	Peer             PeerConfig `json:"peer"`
 	PeerStr          string     `json:"peer_str"`
 	Config           string     `json:"config"`
 	TgId             int        `json:"tg_id"`
+	Email            string     `json:"email"`
+	WebhookURL       string     `json:"webhook_url"`
+	NotifyChannels   []string   `json:"notify_channels"`  // предпочитаемые каналы уведомлений, пусто — все доступные
+	LatestHandshake  time.Time  `json:"latest_handshake"` // последнее рукопожатие по данным устройства
+	CurrentEndpoint  string     `json:"current_endpoint"` // текущий адрес клиента по данным устройства
+	FirstSeen        time.Time  `json:"first_seen"`
+	LastSeen         time.Time  `json:"last_seen"`
+	CreatedAt        time.Time  `json:"created_at"`
+	InactiveSince    time.Time  `json:"inactive_since"` // когда клиент помечен неактивным политикой простоя
+	ActivatedAt      time.Time  `json:"activated_at"`   // последняя активация, от неё отсчитывается простой без новых рукопожатий
 }
 
 // Управление сервером WireGuard
 type WireGuardConfig struct {
-	PrivateKey string         `json:"private_key"`
-	PublicKey  string         `json:"public_key"`
-	Endpoint   string         `json:"endpoint"`
-	ListenPort string         `json:"listen_port"`
-	InterName  string         `json:"inter_name"`
-	BotToken   string         `json:"bot_token"`
-	Clients    map[int]Client `json:"clients"` // Используем карту клиентов
+	SchemaVersion        int                 `json:"schema_version"` // версия схемы файла состояния, см. StateSchemaVersion
+	PrivateKey           string              `json:"private_key"`
+	PublicKey            string              `json:"public_key"`
+	Endpoint             string              `json:"endpoint"`
+	ListenPort           string              `json:"listen_port"`
+	InterName            string              `json:"inter_name"`
+	Address              string              `json:"address"`        // адрес интерфейса с маской, пусто — 10.0.0.1/24
+	InterfaceConf        string              `json:"interface_conf"` // секция [Interface] импортированного wg0.conf, пусто — по шаблону
+	BotToken             string              `json:"bot_token"`
+	AdminTgIds           []int               `json:"admin_tg_ids"` // Telegram ID администраторов для уведомлений
+	Inactivity           InactivityPolicy    `json:"inactivity"`
+	SessionRetentionDays int                 `json:"session_retention_days"` // срок хранения журнала сессий в днях, 0 — 90 дней
+	LinkCodes            map[string]LinkCode `json:"link_codes"`             // одноразовые коды привязки Telegram
+	Notify               NotifyConfig        `json:"notify"`
+	Webhooks             []WebhookEndpoint   `json:"webhooks"`    // подписки на события жизненного цикла клиентов
+	Provisioned          ProvisionRecord     `json:"provisioned"` // что создано на хосте провижинингом
+	Clients              map[int]Client      `json:"clients"`     // Используем карту клиентов
+
+	migrated bool // загружен из файла старой схемы и ещё не сохранён
 }
 
 // ------------------------ сохранение и загрузка данных ------------------------
 // Метод сохранения WireGuardConfig в JSON файл
 func (config *WireGuardConfig) SaveToFile(filename string) error {
+	config.SchemaVersion = StateSchemaVersion
 	// Преобразуем конфигурацию в JSON
 	data, err := json.MarshalIndent(config, "", "  ")
 	if err != nil {
 		return err
 	}
-	// Записываем данные в файл
-	err = ioutil.WriteFile(filename, data, 0644)
+	// Записываем данные в файл: в нём ключи клиентов и токен бота,
+	// поэтому только для владельца
+	err = writePrivateFile(filename, data)
 	if err != nil {
 		return err
 	}
+	config.migrated = false
 	return nil
 }
 
-// Метод загрузки WireGuardConfig из JSON файла
+// Метод загрузки WireGuardConfig из JSON файла. Файл старой версии схемы
+// сохраняется рядом с суффиксом .v<версия>.bak и мигрируется; файл более
+// новой версии не загружается. После миграции migrated
+// установлен до сохранения.
 func (config *WireGuardConfig) LoadFromFile(filename string) error {
 	// Проверяем, существует ли файл
 	_, err := os.Stat(filename)
@@ -85,96 +126,92 @@ func (config *WireGuardConfig) LoadFromFile(filename string) error {
 		return err
 	}
 
+	migrated, version, err := migrateState(data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	if version != StateSchemaVersion {
+		path, err := backupStateFile(filename, data, version)
+		if err != nil {
+			return fmt.Errorf("failed to back up %s before migration: %v", filename, err)
+		}
+		log.Printf("Состояние мигрировано со схемы %d на %d, прежний файл: %s", version, StateSchemaVersion, path)
+	}
+
 	// Раскодируем JSON данные в структуру config
-	err = json.Unmarshal(data, config)
+	err = json.Unmarshal(migrated, config)
 	if err != nil {
 		return err
 	}
+	config.migrated = version != StateSchemaVersion
 	return nil
 }
 
 // ------------------------ методы для клиентов ------------------------
-// Остановка клиента
-func (wg WireGuardConfig) StopClient(id int) {
+// Остановка клиента. Ошибки: ErrClientNotFound, ErrAlreadyStopped, ErrApplyFailed
+func (wg WireGuardConfig) StopClient(id int) error {
 	client, exists := wg.Clients[id]
 	if !exists {
-		log.Printf("Клиент с id %d не найден", id)
-		return
+		return clientNotFound(id)
 	}
-	defer func() { wg.Clients[id] = client }()
-	//fmt.Println(wg.Clients[id])
-
-	filePath := "/etc/wireguard/wg0.conf"
-	content, err := os.ReadFile(filePath)
-	if err != nil {
-		log.Printf("Ошибка чтения файла конфигурации: %v", err)
-		return
+	if !client.Status {
+		return fmt.Errorf("%w: %d", ErrAlreadyStopped, id)
 	}
-	defer restWireguard()
 
-	fileContent := string(content)
+	before := client
 	client.Status = false
-	updatedContent := strings.Replace(fileContent, client.PeerStr, "", 1)
-
-	err = os.WriteFile(filePath, []byte(updatedContent), 0644)
-	if err != nil {
-		log.Printf("Ошибка записи файла конфигурации: %v", err)
-		return
+	wg.Clients[id] = client
+	if err := wg.applyConfig(fmt.Sprintf("stop client %d", id)); err != nil {
+		wg.Clients[id] = before
+		return err
 	}
-
 	log.Printf("Клиент с id %d остановлен", id)
+	return nil
 }
 
-// Активация клиента
-func (wg WireGuardConfig) ActClient(id int) {
+// Активация клиента. Ошибки: ErrClientNotFound, ErrAlreadyActive, ErrApplyFailed
+func (wg WireGuardConfig) ActClient(id int) error {
 	client, exists := wg.Clients[id]
 	if !exists {
-		log.Printf("Клиент с id %d не найден", id)
-		return
+		return clientNotFound(id)
 	}
-	//fmt.Println(wg.Clients[id])
-	defer restWireguard()
-
-	filePath := "/etc/wireguard/wg0.conf"
-	content, err := os.ReadFile(filePath)
-	if err != nil {
-		log.Printf("Ошибка чтения файла конфигурации: %v", err)
-		return
+	if client.Status {
+		return fmt.Errorf("%w: %d", ErrAlreadyActive, id)
 	}
-	defer func() { wg.Clients[id] = client }()
 
+	before := client
 	client.Status = true
-	updatedContent := string(content) + "\n" + client.PeerStr
-
-	err = os.WriteFile(filePath, []byte(updatedContent), 0644)
-	if err != nil {
-		log.Printf("Ошибка записи файла конфигурации: %v", err)
-		return
+	// Активация снимает пометку простоя, срок отсчитывается заново
+	client.InactiveSince = time.Time{}
+	client.ActivatedAt = time.Now()
+	wg.Clients[id] = client
+	if err := wg.applyConfig(fmt.Sprintf("activate client %d", id)); err != nil {
+		wg.Clients[id] = before
+		return err
 	}
-
 	log.Printf("Клиент с id %d активирован", id)
+	return nil
 }
 
-// Удаление клиента
-func (wg *WireGuardConfig) DeleteClient(id int) {
-	wg.StopClient(id)
-
-	//err := os.Remove(fmt.Sprintf("/etc/wireguard/wg_client_%d_private", id))
-	//if err != nil {
-	//	log.Printf("Не удалось удалить файл: %v", err)
-	//}
-	//
-	//err = os.Remove(fmt.Sprintf("/etc/wireguard/wg_client_%d_public", id))
-	//if err != nil {
-	//	log.Printf("Не удалось удалить файл: %v", err)
-	//}
+// Удаление клиента. Ошибки: ErrClientNotFound, ErrApplyFailed
+func (wg *WireGuardConfig) DeleteClient(id int) error {
+	client, exists := wg.Clients[id]
+	if !exists {
+		return clientNotFound(id)
+	}
 
 	delete(wg.Clients, id)
+	if err := wg.applyConfig(fmt.Sprintf("delete client %d", id)); err != nil {
+		wg.Clients[id] = client
+		return err
+	}
+	return nil
 }
 
 // вывод всех клиентов
 func (clients *WireGuardConfig) AllClients() string {
 	text := ""
+	now := time.Now()
 	for id, client := range clients.Clients {
 		var stat string
 		if client.Status {
@@ -182,7 +219,7 @@ func (clients *WireGuardConfig) AllClients() string {
 		} else {
 			stat = "Остановлен"
 		}
-		text += fmt.Sprintf("Клиент %d статус %s адресс %s \n", id, stat, client.AddressClient)
+		text += fmt.Sprintf("Клиент %d статус %s адресс %s подключение %s \n", id, stat, client.AddressClient, client.Presence(now))
 	}
 	return text
 
@@ -194,100 +231,336 @@ func (wg *WireGuardConfig) AddWireguardClient(clientID int) (Client, int, error)
 	if wg.Clients == nil {
 		wg.Clients = make(map[int]Client)
 	}
-	defer restWireguard()
 	// Проверяем, существует ли клиент
-	client, exists := wg.Clients[clientID]
-	if !exists {
-		client = Client{Id: clientID}
-		wg.Clients[clientID] = client
-	}
-	defer func() { wg.Clients[clientID] = client }()
+	previous, exists := wg.Clients[clientID]
 	// Генерация ключей для клиента
-	var privateKey, publicKey bytes.Buffer
+	var privateKey bytes.Buffer
 	cmd := exec.Command("wg", "genkey")
 	cmd.Stdout = &privateKey
-	err := cmd.Run()
-
-	client.PrivateClientKey = strings.TrimSpace(privateKey.String())
-	cmd = exec.Command("wg", "pubkey")
-	cmd.Stdin = &privateKey
-	cmd.Stdout = &publicKey
-	err = cmd.Run()
-
-	client.PublicClientKey = strings.TrimSpace(publicKey.String())
-	client.AddressClient = fmt.Sprintf("10.0.0.%d/24", clientID)
-	client.Peer.Endpoint = wg.Endpoint
-	client.Peer.PublicKey = wg.PublicKey
-	peer := fmt.Sprintf("\n[Peer]\nPublicKey = %s\nAllowedIPs = %s\n", strings.TrimSpace(publicKey.String()), fmt.Sprintf("10.0.0.%d/24", clientID))
-	client.PeerStr = peer
-	filePath := "/etc/wireguard/wg0.conf"
-	f, err := os.OpenFile(filePath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err := cmd.Run(); err != nil {
+		return Client{}, 0, fmt.Errorf("failed to generate client key: %v", err)
+	}
+	private := strings.TrimSpace(privateKey.String())
+	publicKey, err := publicKeyFor(private)
 	if err != nil {
-		return Client{}, 0, err
+		return Client{}, 0, fmt.Errorf("failed to derive client public key: %v", err)
 	}
-	defer f.Close()
-	if _, err = f.WriteString(peer); err != nil {
+
+	client := wg.clientWithKeys(clientID, private, publicKey)
+	wg.Clients[clientID] = client
+	if err := wg.applyConfig(fmt.Sprintf("add client %d", clientID)); err != nil {
+		if exists {
+			wg.Clients[clientID] = previous
+		} else {
+			delete(wg.Clients, clientID)
+		}
 		return Client{}, 0, err
+	}
+	return client, clientID, nil
+}
 
+// Клиент с новыми ключами, каким его запишет AddWireguardClient; по нему же
+// строится план добавления. Прежний клиент с тем же id сохраняет остальные поля.
+func (wg *WireGuardConfig) clientWithKeys(clientID int, privateKey, publicKey string) Client {
+	client, exists := wg.Clients[clientID]
+	if !exists {
+		client = Client{Id: clientID, CreatedAt: time.Now()}
 	}
+	client.PrivateClientKey = privateKey
+	client.PublicClientKey = publicKey
+	client.PresharedKey = ""
+	client.AddressClient = wg.clientAddress(clientID)
+	client.Peer.Endpoint = wg.Endpoint
+	client.Peer.PublicKey = wg.PublicKey
+	client.PeerStr = fmt.Sprintf("\n[Peer]\nPublicKey = %s\nAllowedIPs = %s\n", publicKey, client.AddressClient)
 	client.Status = true
 	// Генерация и сохранение конфигурации клиента
-	clientConfig := fmt.Sprintf(`[Interface]
-Address = %s
-PrivateKey = %s
-DNS = 8.8.8.8
-
-[Peer]
-Endpoint = %s
-PublicKey = %s
-AllowedIPs = 0.0.0.0/0
-    `, client.AddressClient, client.PrivateClientKey, wg.Endpoint, wg.PublicKey)
-
-	client.Config = clientConfig
-	return client, clientID, nil
+	client.Config = wg.ClientConfig(client).WgQuick()
+	return client
 }
 
 // ------------------------ методы для сервера ------------------------
-// автоматический запуск сервера wiregguard
-func (wg *WireGuardConfig) Autostart() {
-	wg.RandomPort()
-	wg.GetIPAndInterfaceName()
-	wg.GenServerKeys()
-	wg.GenerateWireGuardConfig()
-	// wg_client.CollectTraffic()
-	wg.WireguardStart()
+// автоматический запуск сервера wiregguard.
+// Повторный вызов сходится к уже настроенному серверу: ключи, порт и адрес
+// берутся из состояния или существующей установки, wg0.conf собирается заново
+// из сохранённых клиентов и перезаписывается только при изменениях.
+// Шаги записываются в журнал; при ошибке выполненные шаги отменяются.
+// Созданное на хосте отмечается в Provisioned для DropWireguard.
+func (wg *WireGuardConfig) Autostart() error {
+	defer metrics.ObserveApply(time.Now())
+	j := NewJournal("provision")
+	wasActive := wireguardActive()
+	record := wg.Provisioned
+	if record.At.IsZero() && wg.PrivateKey != "" {
+		// Сервер настроен версией без записи провижининга
+		wg.Provisioned = wg.legacyProvisionRecord()
+	}
+	_, statErr := os.Stat(wgConfigFile)
+	configExisted := statErr == nil
+
+	err := j.Do("server settings", func() (func() error, error) {
+		before := *wg
+		keyFiles := snapshotFiles(serverPrivateKeyFile, serverPublicKeyFile)
+		undo := func() error {
+			wg.PrivateKey, wg.PublicKey = before.PrivateKey, before.PublicKey
+			wg.ListenPort, wg.Endpoint, wg.InterName = before.ListenPort, before.Endpoint, before.InterName
+			return keyFiles.restore()
+		}
+
+		wg.adoptExistingInstall()
+		if wg.ListenPort == "" {
+			wg.RandomPort()
+		}
+		if wg.InterName == "" || wg.Endpoint == "" {
+			if err := wg.GetIPAndInterfaceName(); err != nil {
+				return nil, errors.Join(err, undo())
+			}
+		}
+		if wg.PrivateKey == "" {
+			if err := wg.GenServerKeys(); err != nil {
+				return nil, errors.Join(err, undo())
+			}
+			if keyFiles[serverPrivateKeyFile] == nil {
+				wg.Provisioned.KeyFiles = true
+			}
+		}
+		return undo, nil
+	})
+	if err != nil {
+		wg.Provisioned = record
+		return applyFailed(j.Finish(err))
+	}
+
+	changed, err := wg.configStep(j, wasActive)
+	if err == nil {
+		err = wg.startSteps(j, changed)
+	}
+	if err = j.Finish(err); err != nil {
+		wg.Provisioned = record
+		return applyFailed(err)
+	}
+	if !configExisted {
+		wg.Provisioned.ConfigFile = true
+	}
+	wg.Provisioned.At = time.Now()
+	return nil
+}
+
+// Применение конфигурации из состояния: запись wg0.conf и, если интерфейс
+// работает, wg syncconf; перезапуск — только при изменении секции
+// [Interface]. Остановленный интерфейс не запускается: файл применится при
+// следующем старте. При ошибке прежний wg0.conf восстанавливается.
+func (wg *WireGuardConfig) applyConfig(operation string) error {
+	defer metrics.ObserveApply(time.Now())
+	j := NewJournal(operation)
+	wasActive := wireguardActive()
+	previous, _ := os.ReadFile(wgConfigFile)
+	changed, err := wg.configStep(j, wasActive)
+	if err == nil && changed && wasActive {
+		if interfaceChanged(previous) {
+			err = restartStep(j)
+		} else {
+			err = syncStep(j)
+		}
+	}
+	return applyFailed(j.Finish(err))
+}
+
+// Шаг записи wg0.conf. Отмена возвращает прежний файл и, если интерфейс
+// работал, перезапускает его с прежней конфигурацией.
+func (wg *WireGuardConfig) configStep(j *Journal, wasActive bool) (bool, error) {
+	changed := false
+	err := j.Do("write "+wgConfigFile, func() (func() error, error) {
+		previous := snapshotFiles(wgConfigFile)
+		var err error
+		if changed, err = wg.GenerateWireGuardConfig(); err != nil || !changed {
+			return nil, err
+		}
+		return func() error {
+			if err := previous.restore(); err != nil {
+				return err
+			}
+			if wasActive {
+				return restWireguard()
+			}
+			return nil
+		}, nil
+	})
+	return changed, err
+}
+
+// Шаг перезапуска wg-quick@wg0 с проверкой, что интерфейс поднялся
+func restartStep(j *Journal) error {
+	return j.Do("restart wg-quick@wg0", func() (func() error, error) {
+		if err := restWireguard(); err != nil {
+			return nil, err
+		}
+		if !wireguardActive() {
+			return nil, fmt.Errorf("wg-quick@wg0 is not active after restart")
+		}
+		return nil, nil
+	})
+}
+
+// Шаг wg syncconf: пиры работающего wg0 приводятся к wg0.conf без
+// перезапуска, установленные туннели не рвутся
+func syncStep(j *Journal) error {
+	return j.Do("wg syncconf wg0", func() (func() error, error) {
+		return nil, syncWireguard()
+	})
+}
+
+// wg syncconf wg0 с конфигурацией из wg-quick strip: без полей wg-quick
+func syncWireguard() error {
+	var stripped, stderr bytes.Buffer
+	cmd := exec.Command("wg-quick", "strip", "wg0")
+	cmd.Stdout, cmd.Stderr = &stripped, &stderr
+	if err := cmd.Run(); err != nil {
+		return commandError("wg-quick", []string{"strip", "wg0"}, stderr.Bytes(), err)
+	}
+	f, err := os.CreateTemp("", "wg0-*.conf")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(stripped.Bytes())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return runCommand("wg", "syncconf", "wg0", f.Name())
+}
+
+// Содержимое файлов на момент снимка; nil — файла не было
+type fileSnapshot map[string][]byte
+
+func snapshotFiles(paths ...string) fileSnapshot {
+	snap := fileSnapshot{}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			data = nil
+		}
+		snap[path] = data
+	}
+	return snap
+}
+
+// Возврат файлов к снимку: отсутствовавшие удаляются
+func (snap fileSnapshot) restore() error {
+	var errs []error
+	for path, data := range snap {
+		if data == nil {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		if _, err := writeFileIfChanged(path, data, 0600); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Ключ и порт уже установленного сервера, если в состоянии их нет
+func (wg *WireGuardConfig) adoptExistingInstall() {
+	privateKey, listenPort := readInterfaceSettings(wgConfigFile)
+	if wg.PrivateKey == "" {
+		if privateKey == "" {
+			if data, err := os.ReadFile(serverPrivateKeyFile); err == nil {
+				privateKey = strings.TrimSpace(string(data))
+			}
+		}
+		if privateKey != "" {
+			wg.PrivateKey = privateKey
+			wg.PublicKey = ""
+		}
+	}
+	if wg.ListenPort == "" && listenPort != "" {
+		wg.ListenPort = listenPort
+		// Адрес сервера содержит порт, поэтому определяется заново
+		wg.Endpoint = ""
+	}
+	if wg.PrivateKey != "" && wg.PublicKey == "" {
+		publicKey, err := publicKeyFor(wg.PrivateKey)
+		if err != nil {
+			log.Printf("Ошибка получения публичного ключа сервера: %v", err)
+			return
+		}
+		wg.PublicKey = publicKey
+	}
+}
+
+// PrivateKey и ListenPort из секции [Interface] файла конфигурации
+func readInterfaceSettings(path string) (privateKey, listenPort string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", ""
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	inInterface := false
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") {
+			inInterface = strings.EqualFold(line, "[Interface]")
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !inInterface || !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "PrivateKey":
+			privateKey = strings.TrimSpace(value)
+		case "ListenPort":
+			listenPort = strings.TrimSpace(value)
+		}
+	}
+	return privateKey, listenPort
+}
+
+// Публичный ключ по приватному
+func publicKeyFor(privateKey string) (string, error) {
+	var publicKey, stderr bytes.Buffer
+	cmd := exec.Command("wg", "pubkey")
+	cmd.Stdin = strings.NewReader(privateKey + "\n")
+	cmd.Stdout = &publicKey
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", commandError("wg", []string{"pubkey"}, stderr.Bytes(), err)
+	}
+	return strings.TrimSpace(publicKey.String()), nil
 }
 
 // генерируем ключи сервера
-func (wg *WireGuardConfig) GenServerKeys() {
+func (wg *WireGuardConfig) GenServerKeys() error {
 	//генерируем ключи
-	var privateKey bytes.Buffer
+	var privateKey, stderr bytes.Buffer
 	cmd := exec.Command("wg", "genkey")
 	cmd.Stdout = &privateKey
-	err := cmd.Run()
-	if err != nil {
-		log.Fatalf("failed to generate private key: %v", err)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to generate private key: %w", commandError("wg", []string{"genkey"}, stderr.Bytes(), err))
 	}
-	// Сохраняем приватный ключ в переменную
-	privatekey := strings.ReplaceAll(privateKey.String(), "\n", "")
+	privatekey := strings.TrimSpace(privateKey.String())
 	// Используем приватный ключ для генерации публичного ключа
-	var publicKey bytes.Buffer
-	cmd = exec.Command("wg", "pubkey")
-	cmd.Stdin = &privateKey
-	cmd.Stdout = &publicKey
-
-	err = cmd.Run()
+	publickey, err := publicKeyFor(privatekey)
 	if err != nil {
-		log.Fatalf("failed to generate public key: %v", err)
+		return fmt.Errorf("failed to generate public key: %w", err)
 	}
-	publickkey := strings.ReplaceAll(publicKey.String(), "\n", "")
 	//запись
-	os.WriteFile("/etc/wireguard/privatekey", []byte(privatekey), 0600)
-	os.WriteFile("/etc/wireguard/publickey", []byte(publickkey), 0600)
-	// Сохраняем публичный ключ в переменную
-	time.Sleep(time.Second * 5)
-	wg.PublicKey = publickkey
+	if err := os.WriteFile(serverPrivateKeyFile, []byte(privatekey), 0600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(serverPublicKeyFile, []byte(publickey), 0600); err != nil {
+		return err
+	}
+	wg.PublicKey = publickey
 	wg.PrivateKey = privatekey
+	return nil
 }
 
 // генерация рандомного порта
@@ -354,178 +627,297 @@ func isWirelessInterface(name string) bool {
 	return strings.HasPrefix(name, "w") || strings.Contains(name, "wl") || strings.Contains(name, "wlan")
 }
 
-// Генерация конфигурации WireGuard
-func (wg *WireGuardConfig) GenerateWireGuardConfig() {
-	//генерация конфига для мурвера
+// Секция [Peer] клиента в wg0.conf
+func (client Client) peerSection() string {
+	if client.PeerStr != "" {
+		return client.PeerStr
+	}
+	return canonicalPeer(client)
+}
+
+// Адрес клиента с номером id в сети интерфейса. В сети по умолчанию
+// сохраняется прежний вид 10.0.0.<id>/24, в импортированной — адрес /32.
+func (wg *WireGuardConfig) clientAddress(id int) string {
+	ip, ipNet, err := net.ParseCIDR(wg.Address)
+	if wg.Address == "" || err != nil || ip.To4() == nil {
+		return fmt.Sprintf("10.0.0.%d/24", id)
+	}
+	n := ipv4Number(ipNet.IP) + uint32(id)
+	return fmt.Sprintf("%d.%d.%d.%d/32", n>>24, n>>16&0xff, n>>8&0xff, n&0xff)
+}
+
+// Адрес интерфейса сервера
+func (wg *WireGuardConfig) ServerAddress() string {
+	if wg.Address == "" {
+		return "10.0.0.1/24"
+	}
+	return wg.Address
+}
+
+// Содержимое wg0.conf: интерфейс сервера и активные клиенты по возрастанию id.
+// Секция [Interface] импортированной конфигурации сохраняется как была.
+func (wg *WireGuardConfig) ServerConfig() (string, error) {
 	tmpl := `[Interface]
 PrivateKey = {{.PrivateKey}}
-Address = 10.0.0.1/24
+Address = {{.ServerAddress}}
 ListenPort = {{.ListenPort}}
 PostUp = iptables -A FORWARD -i %i -j ACCEPT; iptables -t nat -A POSTROUTING -o {{.InterName}} -j MASQUERADE
-PostDown = iptables -D FORWARD -i %i -j ACCEPT; iptables -t nat -D POSTROUTING -o {{.InterName}} -j MASQUERADE`
-
-	t := template.Must(template.New("wgConfig").Parse(tmpl))
+PostDown = iptables -D FORWARD -i %i -j ACCEPT; iptables -t nat -D POSTROUTING -o {{.InterName}} -j MASQUERADE
+`
 
 	var buf bytes.Buffer
-	if err := t.Execute(&buf, wg); err != nil {
+	if wg.InterfaceConf != "" {
+		buf.WriteString(wg.InterfaceConf)
+	} else {
+		t := template.Must(template.New("wgConfig").Parse(tmpl))
+		if err := t.Execute(&buf, wg); err != nil {
+			return "", err
+		}
 	}
-	// Генерация случайного числа от 0 до 99999
-	// Открытие файла для записи
-	filePath := "/etc/wireguard/wg0.conf"
-	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		fmt.Printf("Ошибка открытия файла: %v\n", err)
-		return
+
+	ids := make([]int, 0, len(wg.Clients))
+	for id, client := range wg.Clients {
+		if client.Status {
+			ids = append(ids, id)
+		}
 	}
-	defer file.Close()
+	sort.Ints(ids)
+	for _, id := range ids {
+		buf.WriteString(wg.Clients[id].peerSection())
+	}
+	return buf.String(), nil
+}
 
-	// Запись данных в файл
-	_, err = file.Write(buf.Bytes())
+// Генерация конфигурации WireGuard. Файл перезаписывается только при изменении
+// содержимого; возвращает true, если он изменился.
+func (wg *WireGuardConfig) GenerateWireGuardConfig() (bool, error) {
+	content, err := wg.ServerConfig()
 	if err != nil {
-		fmt.Printf("Ошибка записи в файл: %v\n", err)
-		return
+		return false, err
 	}
+	return writeFileIfChanged(wgConfigFile, []byte(content), 0600)
+}
 
-	//log.Println("Конфигурация wireguard сгенерирована")
+// Запись файла через временный файл, если содержимое отличается
+func writeFileIfChanged(path string, data []byte, perm os.FileMode) (bool, error) {
+	if current, err := os.ReadFile(path); err == nil && bytes.Equal(current, data) {
+		return false, nil
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	return true, nil
+}
 
+// Запись файла только для владельца. WriteFile задаёт права лишь новому
+// файлу, поэтому файл, созданный прежней версией с 0644, сначала закрывается.
+func writePrivateFile(path string, data []byte) error {
+	if err := os.Chmod(path, 0600); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
 }
 
-func (wg *WireGuardConfig) WireguardStart() {
-	port := wg.ListenPort
-	// настройка форвардинг
-	file, err := os.OpenFile("/etc/sysctl.conf", os.O_APPEND|os.O_WRONLY, 0644)
+// Добавление строки в файл, если такой строки ещё нет. Возвращает true, если строка добавлена.
+func ensureLine(path, line string) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	next, added := withLine(data, line)
+	if !added {
+		return false, nil
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
 	if err != nil {
-		log.Fatalf("failed to open /etc/sysctl.conf: %v", err)
+		return false, err
 	}
 	defer file.Close()
-
-	// Записываем строку в файл
-	_, err = file.WriteString("net.ipv4.ip_forward=1\n")
-	if err != nil {
-		log.Fatalf("failed to write to /etc/sysctl.conf: %v", err)
+	if _, err := file.Write(next[len(data):]); err != nil {
+		return false, err
 	}
-	prt := fmt.Sprintf("%s/udp", port)
-	// Выполняем команду `sysctl -p` для применения изменений
-	cmd := exec.Command("ufw", "allow", prt)
-	err = cmd.Run()
-	if err != nil {
-		log.Printf("failed to apply sysctl changes: %v", err.Error())
+	return true, nil
+}
+
+// Содержимое с добавленной в конец строкой; false — строка уже есть
+func withLine(data []byte, line string) ([]byte, bool) {
+	for _, l := range strings.Split(string(data), "\n") {
+		if strings.ReplaceAll(l, " ", "") == line {
+			return data, false
+		}
 	}
-	// Выполняем команду `sysctl -p` для применения изменений
-	cmd = exec.Command("sysctl", "-p")
-	err = cmd.Run()
-	if err != nil {
-		log.Printf("failed to apply sysctl changes: %v", err.Error())
+	text := line + "\n"
+	if len(data) > 0 && !bytes.HasSuffix(data, []byte("\n")) {
+		text = "\n" + text
 	}
-	//включсение wireguard
-	cmd = exec.Command("systemctl", "enable", "wg-quick@wg0.service")
-	cmd.Run()
-	err = cmd.Err
+	return append(append([]byte(nil), data...), text...), true
+}
+
+// Удаление последнего вхождения строки из файла
+func removeLine(path, line string) error {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		log.Printf("failed to create keys : %v", err.Error())
+		return err
 	}
-	//старт wireguard
-	cmd = exec.Command("systemctl", "start", "wg-quick@wg0.service")
-	cmd.Run()
-	err = cmd.Err
-	if err != nil {
-		log.Printf("failed to create keys : %v", err.Error())
+	lines := strings.Split(string(data), "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		if strings.ReplaceAll(lines[i], " ", "") == line {
+			lines = append(lines[:i], lines[i+1:]...)
+			break
+		}
 	}
-	//log.Printf("Соединение wireguard запущено")
+	_, err = writeFileIfChanged(path, []byte(strings.Join(lines, "\n")), 0644)
+	return err
 }
-func restWireguard() {
-	cmd := exec.Command("systemctl", "restart", "wg-quick@wg0")
-	err := cmd.Run()
+
+// Запуск wg-quick@wg0. Каждый шаг можно повторять: строка sysctl добавляется
+// один раз, правило ufw и enable не дублируются, работающий интерфейс
+// перезапускается только если конфигурация изменилась (configChanged).
+// При ошибке выполненные шаги отменяются.
+func (wg *WireGuardConfig) WireguardStart(configChanged bool) error {
+	j := NewJournal("start")
+	record := wg.Provisioned
+	err := j.Finish(wg.startSteps(j, configChanged))
 	if err != nil {
-		log.Printf("failed to apply sysctl changes: %v", err.Error())
+		wg.Provisioned = record
 	}
-
+	return applyFailed(err)
 }
 
-// Отправка конфигурации через Telegram
-func (wg *WireGuardConfig) SendConfigToUserTg(user_id int) {
-	if wg.BotToken == "" {
-		var value string
-		fmt.Print("Пожалуйста введите токен бота,или 0 для отмены")
-		fmt.Scanln(&value)
-		if value != "0" {
-			wg.BotToken = value
-		} else {
-			return
+// Шаги запуска с компенсирующими действиями. Сделанные изменения отмечаются
+// в Provisioned; при откате вызывающий возвращает прежнюю запись.
+func (wg *WireGuardConfig) startSteps(j *Journal, configChanged bool) error {
+	// настройка форвардинг
+	err := j.Do("persist "+ipForwardLine, func() (func() error, error) {
+		added, err := ensureLine(sysctlFile, ipForwardLine)
+		if err != nil || !added {
+			return nil, err
 		}
+		wg.Provisioned.SysctlLine = true
+		return func() error { return removeLine(sysctlFile, ipForwardLine) }, nil
+	})
+	if err != nil {
+		return err
 	}
-	//создание бота
-	Cl, _ := wg.Clients[user_id]
 
-	chatID := telebot.ChatID(int64(Cl.TgId))
-	bot, err := telebot.NewBot(telebot.Settings{
-		Token: wg.BotToken,
+	err = j.Do("enable ip forwarding", func() (func() error, error) {
+		previous, err := os.ReadFile(ipForwardProc)
+		if err != nil {
+			return nil, err
+		}
+		value := strings.TrimSpace(string(previous))
+		if value == "1" {
+			return nil, nil
+		}
+		if err := runCommand("sysctl", "-w", "net.ipv4.ip_forward=1"); err != nil {
+			return nil, err
+		}
+		if wg.Provisioned.IPForwardBefore == "" {
+			wg.Provisioned.IPForwardBefore = value
+		}
+		return func() error { return runCommand("sysctl", "-w", "net.ipv4.ip_forward="+value) }, nil
 	})
-
-	//файл с конфигураций
-	reader := strings.NewReader(Cl.Config)
-	// Создаем документ для отправки, передавая reader как содержимое файла
-	document := &telebot.Document{
-		File:     telebot.FromReader(reader), // Используем io.Reader
-		FileName: "wgconf.conf",              // Указываем имя файла
-		Caption:  "WireGuard Configuration",  // Опциональная подпись к файлу
-	}
 	if err != nil {
-		log.Fatalf("Failed to create bot: %v", err)
+		return err
 	}
-	//отправка файла
-	if _, err := bot.Send(chatID, document); err != nil {
-		log.Fatalf("Failed to send message: %v", err)
+
+	prt := fmt.Sprintf("%s/udp", wg.ListenPort)
+	if _, lookErr := exec.LookPath("ufw"); lookErr != nil {
+		j.Skip("ufw allow "+prt, "ufw is not installed")
+	} else {
+		err = j.Do("ufw allow "+prt, func() (func() error, error) {
+			out, _ := exec.Command("ufw", "status").Output()
+			existed := strings.Contains(string(out), prt)
+			if err := runCommand("ufw", "allow", prt); err != nil || existed {
+				return nil, err
+			}
+			wg.Provisioned.UfwRule = prt
+			return func() error { return runCommand("ufw", "delete", "allow", prt) }, nil
+		})
+		if err != nil {
+			return err
+		}
 	}
-}
 
-// удаление wireguard
-func (wg *WireGuardConfig) DropWireguard() {
-	// очистка папки
-	cmd := exec.Command("rm", "-rf", "/etc/wireguard/*")
-	cmd.Run()
-	err := cmd.Err
+	//включсение wireguard
+	err = j.Do("enable wg-quick@wg0", func() (func() error, error) {
+		if exec.Command("systemctl", "is-enabled", "--quiet", "wg-quick@wg0.service").Run() == nil {
+			return nil, nil
+		}
+		if err := runCommand("systemctl", "enable", "wg-quick@wg0.service"); err != nil {
+			return nil, err
+		}
+		wg.Provisioned.UnitEnabled = true
+		return func() error { return runCommand("systemctl", "disable", "wg-quick@wg0.service") }, nil
+	})
 	if err != nil {
-		log.Printf("failed to create keys : %v", err.Error())
+		return err
 	}
-	//отключение wireguard
-	cmd = exec.Command("systemctl", "disable", "wg-quick@wg0.service")
-	cmd.Run()
-	err = cmd.Err
-	if err != nil {
-		log.Printf("failed to create keys : %v", err.Error())
+
+	//старт wireguard
+	if wireguardActive() {
+		if configChanged {
+			return restartStep(j)
+		}
+		return nil
 	}
-	filePath := "/etc/sysctl.conf"
+	return j.Do("start wg-quick@wg0", func() (func() error, error) {
+		stop := func() error { return runCommand("systemctl", "stop", "wg-quick@wg0.service") }
+		if err := runCommand("systemctl", "start", "wg-quick@wg0.service"); err != nil {
+			return nil, errors.Join(err, stop())
+		}
+		if !wireguardActive() {
+			return nil, errors.Join(fmt.Errorf("wg-quick@wg0 is not active after start"), stop())
+		}
+		return stop, nil
+	})
+}
+
+// Запущен ли wg-quick@wg0
+func wireguardActive() bool {
+	return exec.Command("systemctl", "is-active", "--quiet", "wg-quick@wg0.service").Run() == nil
+}
 
-	// Открываем файл для чтения
-	file, err := os.Open(filePath)
+// Выполнение команды, вывод упавшей команды попадает в CommandError
+func runCommand(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
 	if err != nil {
-		log.Fatalf("failed to open file: %v", err)
+		return commandError(name, args, out, err)
 	}
-	defer file.Close()
+	return nil
+}
 
-	// Читаем содержимое файла построчно
-	var lines []string
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		// Добавляем в список все строки, кроме той, которую нужно удалить
-		if !strings.Contains(line, "net.ipv4.ip_forward=1") {
-			lines = append(lines, line)
-		}
+func restWireguard() error {
+	start := time.Now()
+	err := runCommand("systemctl", "restart", "wg-quick@wg0")
+	metrics.ObserveRestart(start, err)
+	return err
+}
+
+// Отправка конфигурации через Telegram. Токен бота берётся только из
+// состояния: без него ErrNoBotToken.
+func (wg *WireGuardConfig) SendConfigToUserTg(user_id int) error {
+	if wg.BotToken == "" {
+		return ErrNoBotToken
 	}
-	if err := scanner.Err(); err != nil {
-		log.Fatalf("error reading file: %v", err)
+	Cl, exists := wg.Clients[user_id]
+	if !exists {
+		return clientNotFound(user_id)
+	}
+	if Cl.TgId == 0 {
+		return fmt.Errorf("%w: %d", ErrNoTelegramID, user_id)
 	}
 
-	// Перезаписываем файл без нужной строки
-	err = os.WriteFile(filePath, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	n, err := ConfigNotification(Cl)
 	if err != nil {
-		log.Fatalf("failed to write file: %v", err)
+		return err
 	}
-
-	fmt.Println("Line removed successfully")
-	log.Printf("Папка конфиураций wireguuard очищена")
+	return TelegramNotifier{Token: wg.BotToken}.Notify(Cl.Contact(), n)
 }
 
 // // Сбор трафика
@@ -539,8 +931,11 @@ func (wg *WireGuardConfig) DropWireguard() {
 // Структура для хранения выходных данных команды wg-json
 
 type PeerStats struct {
-	TransferRx uint64
-	TransferTx uint64
+	TransferRx      uint64
+	TransferTx      uint64
+	LatestHandshake time.Time // нулевое время, если рукопожатия ещё не было
+	Endpoint        string
+	AllowedIPs      string
 }
 
 type PeerTraffic struct {
@@ -548,81 +943,71 @@ type PeerTraffic struct {
 	TrafficTx uint64 `json:"traffic_tx"`
 }
 
-// Сбор трафика, возвращает map[id]PeerTraffic
-func (wg *WireGuardConfig) CollectTraffic() (map[string]PeerTraffic, error) {
-	cmd := exec.Command("wg", "show")
+// Сбор статистики пиров из `wg show wg0 dump`, возвращает map[публичный ключ]PeerStats
+func (wg *WireGuardConfig) CollectPeerStats() (map[string]PeerStats, error) {
+	cmd := exec.Command("wg", "show", "wg0", "dump")
 	var out bytes.Buffer
 	cmd.Stdout = &out
 	err := cmd.Run()
 	if err != nil {
-		return nil, fmt.Errorf("failed to execute wg show: %v", err)
+		return nil, fmt.Errorf("failed to execute wg show dump: %v", err)
 	}
+	return parsePeerDump(out.String())
+}
 
-	output := out.String()
-	lines := strings.Split(output, "\n")
-
-	trafficData := make(map[string]PeerTraffic)
-
-	var currentPeer string
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if strings.HasPrefix(line, "peer:") {
-			currentPeer = strings.TrimSpace(strings.TrimPrefix(line, "peer:"))
-		} else if strings.HasPrefix(line, "transfer:") && currentPeer != "" {
-			// Пример: "transfer: 3.48 MiB received, 33.46 MiB sent"
-			transferParts := strings.Split(line, ",")
-			if len(transferParts) != 2 {
-				continue
-			}
-
-			rxStr := strings.TrimSpace(strings.TrimPrefix(transferParts[0], "transfer:"))
-			txStr := strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(transferParts[1], ""), "sent"))
-
-			rxBytes, err := parseTraffic(rxStr)
-			if err != nil {
-				log.Printf("Error parsing transfer Rx for peer %s: %v", currentPeer, err)
-				continue
-			}
+// parsePeerDump разбирает вывод `wg show <iface> dump`.
+// Первая строка описывает интерфейс, остальные — пиров:
+// public-key preshared-key endpoint allowed-ips latest-handshake rx tx keepalive
+func parsePeerDump(dump string) (map[string]PeerStats, error) {
+	stats := make(map[string]PeerStats)
+	lines := strings.Split(strings.TrimSpace(dump), "\n")
+	for i, line := range lines {
+		if i == 0 || line == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) < 8 {
+			return nil, fmt.Errorf("invalid dump line: %q", line)
+		}
 
-			txBytes, err := parseTraffic(txStr)
-			if err != nil {
-				log.Printf("Error parsing transfer Tx for peer %s: %v", currentPeer, err)
-				continue
-			}
+		handshake, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse latest handshake: %v", err)
+		}
+		rx, err := strconv.ParseUint(fields[5], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse transfer rx: %v", err)
+		}
+		tx, err := strconv.ParseUint(fields[6], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse transfer tx: %v", err)
+		}
 
-			trafficData[currentPeer] = PeerTraffic{
-				TrafficRx: rxBytes,
-				TrafficTx: txBytes,
-			}
+		peer := PeerStats{TransferRx: rx, TransferTx: tx, AllowedIPs: fields[3]}
+		if handshake > 0 {
+			peer.LatestHandshake = time.Unix(handshake, 0)
 		}
+		if fields[2] != "(none)" {
+			peer.Endpoint = fields[2]
+		}
+		stats[fields[0]] = peer
 	}
-
-	return trafficData, nil
+	return stats, nil
 }
 
-// parseTraffic преобразует строку трафика (например, "3.48 MiB") в байты
-func parseTraffic(trafficStr string) (uint64, error) {
-	parts := strings.Fields(trafficStr)
-	if len(parts) != 2 {
-		return 0, fmt.Errorf("invalid traffic format: %s", trafficStr)
+// Сбор трафика, возвращает map[публичный ключ]PeerTraffic
+func (wg *WireGuardConfig) CollectTraffic() (map[string]PeerTraffic, error) {
+	stats, err := wg.CollectPeerStats()
+	if err != nil {
+		return nil, err
 	}
 
-	value, err := strconv.ParseFloat(parts[0], 64)
-	if err != nil {
-		return 0, fmt.Errorf("failed to parse traffic value: %v", err)
-	}
-
-	unit := parts[1]
-	switch unit {
-	case "B":
-		return uint64(value), nil
-	case "KiB":
-		return uint64(value * 1024), nil
-	case "MiB":
-		return uint64(value * 1024 * 1024), nil
-	case "GiB":
-		return uint64(value * 1024 * 1024 * 1024), nil
-	default:
-		return 0, fmt.Errorf("unknown traffic unit: %s", unit)
+	trafficData := make(map[string]PeerTraffic, len(stats))
+	for key, peer := range stats {
+		trafficData[key] = PeerTraffic{
+			TrafficRx: peer.TransferRx,
+			TrafficTx: peer.TransferTx,
+		}
 	}
+	return trafficData, nil
 }